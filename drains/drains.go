@@ -35,47 +35,78 @@ func PrintMetrics() {
 	drains_mutex.Unlock()
 }
 
+// A dial in progress, others dialing the same url wait for it to finish.
+type pendingDial struct {
+	done chan struct{}
+	err  error
+}
+
+var pending_dials map[string]*pendingDial
+
+// Dial returns the drain for the url, creating it if needed. The drains lock
+// isn't held while a new drain connects so a slow destination doesn't hold up
+// dialing (or undialing) others.
 func Dial(Id string, Url string) (Drain, error) {
 	if Url == "" {
 		return nil, fmt.Errorf("The specified route URL was blank.")
 	}
 
-	bad_hosts_mutex.Lock()
-	if _, ok := bad_hosts[Url]; ok {
+	for {
+		bad_hosts_mutex.Lock()
+		if _, ok := bad_hosts[Url]; ok {
+			bad_hosts_mutex.Unlock()
+			return nil, fmt.Errorf("Host is part of a bad host list.")
+		}
 		bad_hosts_mutex.Unlock()
-		return nil, fmt.Errorf("Host is part of a bad host list.")
-	}
-	bad_hosts_mutex.Unlock()
 
-	// This lock must remain above this line.
-	drains_mutex.Lock()
-	defer drains_mutex.Unlock()
+		drains_mutex.Lock()
+		// If we already have a pool for this, go ahead and return.
+		if _, ok := drains[Url]; ok {
+			drains_count[Url] = drains_count[Url] + 1
+			drains_mutex.Unlock()
+			return drains[Url], nil
+		}
+		// If someone else is dialing it wait for them, then try again as it may
+		// have failed or been undialed since.
+		if dial, ok := pending_dials[Url]; ok {
+			drains_mutex.Unlock()
+			<-dial.done
+			if dial.err != nil {
+				return nil, dial.err
+			}
+			continue
+		}
 
-	// If we already have a pool for this, go ahead and return.
-	if _, ok := drains[Url]; ok {
-		drains_count[Url] = drains_count[Url] + 1
-		return drains[Url], nil
-	}
+		var drain Drain = nil
+		if strings.HasPrefix(Url, "http://") || strings.HasPrefix(Url, "https://") {
+			drain = &HttpDrain{}
+		} else if strings.HasPrefix(Url, "syslog://") || strings.HasPrefix(Url, "syslog+tcp://") || strings.HasPrefix(Url, "syslog+udp://") || strings.HasPrefix(Url, "syslog+tls://") || strings.HasPrefix(Url, "ssh://") {
+			drain = &SyslogDrain{}
+		} else {
+			drains_mutex.Unlock()
+			return nil, fmt.Errorf("The specified schema format is invalid or not supported")
+		}
+		dial := &pendingDial{done: make(chan struct{})}
+		pending_dials[Url] = dial
+		drains_mutex.Unlock()
 
-	var drain Drain = nil
-	if strings.HasPrefix(Url, "http://") || strings.HasPrefix(Url, "https://") {
-		drain = &HttpDrain{}
-	} else if strings.HasPrefix(Url, "syslog://") || strings.HasPrefix(Url, "syslog+tcp://") || strings.HasPrefix(Url, "syslog+udp://") || strings.HasPrefix(Url, "syslog+tls://") || strings.HasPrefix(Url, "ssh://") {
-		drain = &SyslogDrain{}
-	} else {
-		return nil, fmt.Errorf("The specified schema format is invalid or not supported")
-	}
+		dial.err = drain.Init(Id, Url)
 
-	if err := drain.Init(Id, Url); err != nil {
-		bad_hosts_mutex.Lock()
-		bad_hosts[Url] = true
-		bad_hosts_mutex.Unlock()
-		return nil, err
+		drains_mutex.Lock()
+		delete(pending_dials, Url)
+		if dial.err != nil {
+			bad_hosts_mutex.Lock()
+			bad_hosts[Url] = true
+			bad_hosts_mutex.Unlock()
+		} else {
+			drains_count[Url] = 1
+			drains[Url] = drain
+			drain_keys = append(drain_keys, Url)
+		}
+		close(dial.done)
+		drains_mutex.Unlock()
+		return drain, dial.err
 	}
-	drains_count[Url] = 1
-	drains[Url] = drain
-	drain_keys = append(drain_keys, Url)
-	return drain, nil
 }
 
 func DrainCount(Url string) (int, error) {
@@ -108,18 +139,18 @@ func Undial(Id string, Url string) error {
 					drain_keys = append(drain_keys[:index_to_remove], drain_keys[index_to_remove+1:]...)
 				}
 			} else {
-				return fmt.Errorf("Unable to find active drains for record %s with url %s", Id, Url)
+				return fmt.Errorf("Unable to find active drains for record %s", Id)
 			}
 		}
 	} else {
-		return fmt.Errorf("Unable to find any record %s with url %s", Id, Url)
+		return fmt.Errorf("Unable to find any record %s", Id)
 	}
 	return nil
 }
 
 func CloseAll() {
 	for _, drain := range drain_keys {
-		fmt.Printf("[drains]  Closing drain to %s...", drain)
+		fmt.Printf("[drains]  Closing drain %s...", drains[drain].Id())
 		drains[drain].Close()
 		fmt.Printf("\n")
 	}
@@ -131,6 +162,7 @@ func Init() {
 	drains = make(map[string]Drain)
 	drain_keys = make([]string, 0)
 	drains_count = make(map[string]int)
+	pending_dials = make(map[string]*pendingDial)
 	bad_hosts = make(map[string]bool)
 	// Start bad host check clear
 	bad_hosts_ticker := time.NewTicker(time.Second * 60 * 5)
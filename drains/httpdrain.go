@@ -30,13 +30,14 @@ type HttpDrain struct {
 }
 
 func (l *HttpDrain) Init(Id string, Url string) error {
-	log.Printf("[drains]  Creating URL drain to %s\n", Url)
 	l.id = Id
 	l.url = Url
 	u, err := url.Parse(Url)
 	if err != nil {
 		return err
 	}
+	// the url may have credentials, so only the host and path are logged.
+	log.Printf("[drains]  Creating URL drain to %s://%s%s\n", u.Scheme, u.Host, u.Path)
 	l.packets = make(chan syslog.Packet)
 	l.buffered = make([]syslog.Packet, 0)
 	l.frame = 0
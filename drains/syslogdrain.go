@@ -5,6 +5,7 @@ import (
 	"hash/crc32"
 	"log"
 	"github.com/akkeris/logshuttle/syslog"
+	"github.com/akkeris/logshuttle/urls"
 	"os"
 	"strconv"
 	"strings"
@@ -19,6 +20,7 @@ type SyslogDrain struct {
 	initialConnections int
 	bufferSize         int
 	destinationUrl     string
+	redactedUrl        string // for logs, credentials in the url are masked
 	packets            chan syslog.Packet
 	stopChan           chan struct{}
 	conns              []*syslog.Logger
@@ -56,14 +58,14 @@ func (p *SyslogDrain) connect(increasePool bool, pressure float64) error {
 		network = "tls"
 	} else {
 		atomic.StoreUint32(&p.Attempting, 0)
-		return fmt.Errorf("Warning unknown url schema provided: %s", Url)
+		return fmt.Errorf("Warning unknown url schema provided: %s", p.redactedUrl)
 	}
 
 	if strings.Contains(Url, "://") {
 		host = strings.Split(Url, "://")[1]
 	}
 
-	log.Printf("[drains]  Opening connection to %s\n", host)
+	log.Printf("[drains]  Opening connection to %s\n", p.redactedUrl)
 	dest, err := syslog.Dial("logshuttle.akkeris.local", network, host, nil, time.Second*4, time.Second*4, MaxLogSize)
 	if err != nil {
 		atomic.StoreUint32(&p.Attempting, 0)
@@ -76,7 +78,7 @@ func (p *SyslogDrain) connect(increasePool bool, pressure float64) error {
 	p.conns = append(p.conns, dest)
 
 	if increasePool {
-		log.Printf("[drains] Increasing pool size for %s to %d because back pressure was %f%%\n", p.destinationUrl, p.OpenConnections(), pressure*100)
+		log.Printf("[drains] Increasing pool size for %s to %d because back pressure was %f%%\n", p.redactedUrl, p.OpenConnections(), pressure*100)
 	}
 	atomic.StoreUint32(&p.Attempting, 0)
 	return nil
@@ -88,12 +90,12 @@ func (p *SyslogDrain) OpenConnections() uint32 {
 
 func (p *SyslogDrain) PrintMetrics() {
 	p.Mutex.Lock()
-	log.Printf("[metrics] syslog=%s max#connections=%d count#connections=%d measure#pressure=%f%% count#sent=%d\n", p.destinationUrl, p.MaxConnections, p.OpenConnections(), p.Pressure*100, p.Sent)
+	log.Printf("[metrics] syslog=%s max#connections=%d count#connections=%d measure#pressure=%f%% count#sent=%d\n", p.redactedUrl, p.MaxConnections, p.OpenConnections(), p.Pressure*100, p.Sent)
 	if p.Pressure > 0.98 && p.OpenConnections() == p.MaxConnections {
 		log.Printf("[alert] We've reached our maximum allocated connection count %d and our back pressure is still high %f.\n[alert] If this isn't during startup this could mean a loss of log data.\n", p.OpenConnections(), p.Pressure*100)
 	}
 	for ndx, conn := range p.conns {
-		log.Printf("[metrics] syslog[%d]=%s count#sent=%d count#errors=%d sample#avgtime=%fs\n", ndx, p.destinationUrl, conn.SentCount, conn.ErrorsCount, conn.AvgWriteTime.Seconds())
+		log.Printf("[metrics] syslog[%d]=%s count#sent=%d count#errors=%d sample#avgtime=%fs\n", ndx, p.redactedUrl, conn.SentCount, conn.ErrorsCount, conn.AvgWriteTime.Seconds())
 	}
 	p.Sent = 0
 	p.Mutex.Unlock()
@@ -114,6 +116,7 @@ func (p *SyslogDrain) Init(Id string, DestinationUrl string) error {
 	p.initialConnections = 1
 	p.bufferSize = 512
 	p.destinationUrl = DestinationUrl
+	p.redactedUrl = urls.Redact(DestinationUrl)
 	p.packets = make(chan syslog.Packet, p.bufferSize)
 	p.stopChan = make(chan struct{})
 	p.conns = make([]*syslog.Logger, 0)
@@ -122,22 +125,22 @@ func (p *SyslogDrain) Init(Id string, DestinationUrl string) error {
 	p.Mutex = &sync.Mutex{}
 	p.Pressure = 0
 
-	log.Printf("[drains]  Creating syslog drain to %s\n", p.destinationUrl)
+	log.Printf("[drains]  Creating syslog drain to %s\n", p.redactedUrl)
 	for i := 0; i < p.initialConnections; i++ {
 		if i > 0 {
 			// throttle connections so we don't upset our upstream neighbors.
 			time.Sleep(time.Millisecond * 500)
 		}
 		if err := p.connect(false, 0); err != nil {
-			log.Printf("[drains]  Connection was closed to %s due to %s\n", p.destinationUrl, err)
+			log.Printf("[drains]  Connection was closed to %s due to %s\n", p.redactedUrl, err)
 		}
 	}
 	if p.OpenConnections() == 0 {
-		return fmt.Errorf("Unable to establish connection to %s", p.destinationUrl)
+		return fmt.Errorf("Unable to establish connection to %s", p.redactedUrl)
 	}
 	go p.writeLoop()
 
-	log.Printf("[drains]  Pool successfully created for %s\n", p.destinationUrl)
+	log.Printf("[drains]  Pool successfully created for %s\n", p.redactedUrl)
 	return nil
 }
 
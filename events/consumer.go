@@ -25,6 +25,9 @@ func CreateConsumerCluster(kafkaAddrs []string, kafkaGroup string) *kafka.Consum
 	if os.Getenv("DEBUG") == "true" {
 		config.SetKey("debug", "all")
 	}
+	if err := SetSecurityConfig(config); err != nil {
+		log.Fatal(err)
+	}
 	// See: https://github.com/edenhill/librdkafka/tree/master/CONFIGURATION.md
 	c, err := kafka.NewConsumer(&config)
 	if err != nil {
@@ -35,11 +38,9 @@ func CreateConsumerCluster(kafkaAddrs []string, kafkaGroup string) *kafka.Consum
 
 type LogConsumer struct {
 	kafkaConsumer *kafka.Consumer
-	AppLogs       chan *kafka.Message
-	BuildLogs     chan *kafka.Message
-	WebLogs       chan *kafka.Message
-	IstioWebLogs  chan *kafka.Message
+	Messages      chan *kafka.Message
 	IsOpen        bool
+	Subscription  []string
 	address       []string
 	group         string
 }
@@ -68,17 +69,7 @@ func (lc *LogConsumer) runPooler() {
 		}
 		switch msg := ev.(type) {
 		case *kafka.Message:
-			if strings.HasPrefix(*msg.TopicPartition.Topic, "_") == true {
-				continue
-			} else if *msg.TopicPartition.Topic == "alamoweblogs" {
-				lc.WebLogs <- msg
-			} else if *msg.TopicPartition.Topic == "istio-access-logs" {
-				lc.IstioWebLogs <- msg
-			} else if *msg.TopicPartition.Topic == "alamobuildlogs" {
-				lc.BuildLogs <- msg
-			} else {
-				lc.AppLogs <- msg
-			}
+			lc.Messages <- msg
 		case kafka.Error:
 			log.Printf("%% Error: %v\n", msg)
 			lc.IsOpen = false
@@ -92,7 +83,7 @@ func (lc *LogConsumer) runPooler() {
 			}
 			lc.kafkaConsumer.Close()
 			lc.kafkaConsumer = CreateConsumerCluster(lc.address, lc.group)
-			err := lc.kafkaConsumer.SubscribeTopics([]string{"^.*$"}, nil)
+			err := lc.kafkaConsumer.SubscribeTopics(lc.Subscription, nil)
 			if err != nil {
 				log.Fatalln("Fatal, cannot recover from", err)
 			}
@@ -108,9 +99,9 @@ func (lc *LogConsumer) Refresh() error {
 	if lc.IsOpen == false {
 		return nil
 	}
-	err := lc.kafkaConsumer.SubscribeTopics([]string{"^.*$"}, nil)
+	err := lc.kafkaConsumer.SubscribeTopics(lc.Subscription, nil)
 	if err != nil {
-		log.Println("Error listening to all topics", err)
+		log.Println("Error listening to topics", err)
 	}
 	return err
 }
@@ -125,15 +116,15 @@ func (lc *LogConsumer) Open() error {
 	if lc.group == "" {
 		return errors.New("invalid group")
 	}
+	if lc.Subscription == nil {
+		lc.Subscription = Topics().Subscription()
+	}
 	lc.kafkaConsumer = CreateConsumerCluster(lc.address, lc.group)
-	err := lc.kafkaConsumer.SubscribeTopics([]string{"^.*$"}, nil)
+	err := lc.kafkaConsumer.SubscribeTopics(lc.Subscription, nil)
 	if err != nil {
-		log.Println("Error listening to all topics", err)
+		log.Println("Error listening to topics", err)
 	}
-	lc.AppLogs = make(chan *kafka.Message)
-	lc.BuildLogs = make(chan *kafka.Message)
-	lc.WebLogs = make(chan *kafka.Message)
-	lc.IstioWebLogs = make(chan *kafka.Message)
+	lc.Messages = make(chan *kafka.Message)
 	lc.IsOpen = true
 	go lc.runPooler()
 	return nil
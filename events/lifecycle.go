@@ -0,0 +1,110 @@
+package events
+
+import (
+	"strconv"
+	"strings"
+)
+
+type LifecycleEventType string
+
+// The lifecycle of a dyno (pod), from creation to deletion.
+const (
+	LifecycleCreated     LifecycleEventType = "created"
+	LifecycleScheduled   LifecycleEventType = "scheduled"
+	LifecycleStarted     LifecycleEventType = "started"
+	LifecycleBootTimeout LifecycleEventType = "boot_timeout"
+	LifecycleCrashed     LifecycleEventType = "crashed"
+	LifecycleOOMKilled   LifecycleEventType = "oom_killed"
+	LifecycleEvicted     LifecycleEventType = "evicted"
+	LifecycleExited      LifecycleEventType = "exited"
+	LifecycleDeleted     LifecycleEventType = "deleted"
+)
+
+// LifecycleEvent is a structured pod lifecycle event, it may be sent in
+// place of (or parsed from) a kubernetes "Phase: " log line.
+type LifecycleEvent struct {
+	Type     LifecycleEventType `json:"type"`
+	Reason   string             `json:"reason,omitempty"`
+	Message  string             `json:"message,omitempty"`
+	ExitCode *int               `json:"exit_code,omitempty"`
+}
+
+// Code returns the heroku style error code for the event, if any.
+func (e LifecycleEvent) Code() string {
+	switch e.Type {
+	case LifecycleCrashed:
+		return "H10"
+	case LifecycleBootTimeout:
+		return "R10"
+	case LifecycleOOMKilled:
+		return "R14"
+	}
+	return ""
+}
+
+// IsError is true if the event means the dyno failed.
+func (e LifecycleEvent) IsError() bool {
+	switch e.Type {
+	case LifecycleCrashed, LifecycleBootTimeout, LifecycleOOMKilled, LifecycleEvicted:
+		return true
+	case LifecycleExited:
+		return e.ExitCode != nil && *e.ExitCode != 0
+	}
+	return false
+}
+
+// The signals a container commonly exits from (exit code 128 + signal).
+var exitSignals = map[int]string{
+	129: "SIGHUP",
+	130: "SIGINT",
+	134: "SIGABRT",
+	137: "SIGKILL",
+	139: "SIGSEGV",
+	143: "SIGTERM",
+}
+
+func quoteDesc(desc string) string {
+	return "\"" + strings.Replace(strings.Replace(desc, "\\", "\\\\", -1), "\"", "\\\"", -1) + "\""
+}
+
+// String renders the event as the human readable line drains and sessions
+// receive.
+func (e LifecycleEvent) String() string {
+	switch e.Type {
+	case LifecycleCreated:
+		return "Creating Dyno"
+	case LifecycleScheduled:
+		if e.Reason != "" && e.Reason != "ContainerCreating" {
+			return "Waiting on Dyno (" + e.Reason + ")"
+		}
+		return "Waiting on Dyno"
+	case LifecycleStarted:
+		return "Checking Dyno Health"
+	case LifecycleCrashed:
+		return "at=error code=H10 desc=\"App crashed\""
+	case LifecycleBootTimeout:
+		return "at=error code=R10 desc=\"Boot timeout\""
+	case LifecycleOOMKilled:
+		return "at=error code=R14 desc=\"Memory quota exceeded\""
+	case LifecycleEvicted:
+		if e.Message != "" {
+			return "at=error desc=" + quoteDesc("Dyno evicted: "+e.Message)
+		}
+		return "at=error desc=\"Dyno evicted\""
+	case LifecycleExited:
+		if e.ExitCode == nil {
+			return "Dyno exited"
+		}
+		var causes = []string{"exit code " + strconv.Itoa(*e.ExitCode)}
+		if signal, ok := exitSignals[*e.ExitCode]; ok {
+			causes = append(causes, signal)
+		}
+		if e.Reason != "" && e.Reason != "Error" && e.Reason != "Completed" {
+			causes = append(causes, e.Reason)
+		}
+		return "Dyno exited (" + strings.Join(causes, ", ") + ")"
+	case LifecycleDeleted:
+		return "Deleting Dyno"
+	}
+	return e.Message
+}
@@ -5,7 +5,10 @@ import (
 	"errors"
 	kafka "github.com/confluentinc/confluent-kafka-go/kafka"
 	"log"
+	"os"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 )
 
@@ -40,26 +43,145 @@ type LogSpec struct {
 	Site       string         `json:"site,omitempty"`
 	SitePath   string         `json:"site,omitempty"`
 	Path   string         	  `json:"site,omitempty"`
+	Lifecycle  *LifecycleEvent `json:"lifecycle,omitempty"`
 }
 
-func CreateProducer(kafkaAddrs []string, kafkaGroup string) *kafka.Producer {
-	c, err := kafka.NewProducer(&kafka.ConfigMap{
-		"bootstrap.servers":  strings.Join(kafkaAddrs, ","),
-		"group.id":           kafkaGroup,
-		"session.timeout.ms": 6000,
-		"go.delivery.reports": false,
-	})
+// Validate ensures the log spec has enough information to be routed.
+func (message LogSpec) Validate() error {
+	if message.Topic == "" {
+		return errors.New("a topic is required")
+	}
+	if message.Kubernetes.ContainerName == "" {
+		return errors.New("a kubernetes container_name is required")
+	}
+	if message.Time.IsZero() {
+		return errors.New("a time is required")
+	}
+	return nil
+}
+
+// How long kafka has to acknowledge a message before its considered failed
+// when acknowledgements are required.
+const ackTimeout = time.Second * 30
+
+func producerConfig(kafkaAddrs []string, kafkaGroup string, ackRequired bool) kafka.ConfigMap {
+	config := kafka.ConfigMap{
+		"bootstrap.servers":   strings.Join(kafkaAddrs, ","),
+		"group.id":            kafkaGroup,
+		"session.timeout.ms":  6000,
+		"go.delivery.reports": true,
+	}
+	if ackRequired {
+		config.SetKey("acks", "all")
+		config.SetKey("message.timeout.ms", int(ackTimeout/time.Millisecond))
+	}
+	return config
+}
+
+func CreateProducer(kafkaAddrs []string, kafkaGroup string, ackRequired bool) *kafka.Producer {
+	config := producerConfig(kafkaAddrs, kafkaGroup, ackRequired)
+	if err := SetSecurityConfig(config); err != nil {
+		log.Fatal(err)
+	}
+	c, err := kafka.NewProducer(&config)
 	if err != nil {
 		log.Fatal(err)
 	}
 	return c
 }
 
+type producerMetrics struct {
+	produced       int64
+	delivered      int64
+	deliveryErrors int64
+	produceErrors  int64
+}
+
+// kafkaProducer is the part of a kafka producer the log producer uses, tests
+// replace it to check what's produced without a broker.
+type kafkaProducer interface {
+	Produce(msg *kafka.Message, deliveryChan chan kafka.Event) error
+	Events() chan kafka.Event
+	Flush(timeoutMs int) int
+	Close()
+}
+
 type LogProducer struct {
-	IsOpen   bool
-	address  []string
-	group    string
-	producer *kafka.Producer
+	IsOpen      bool
+	AckRequired bool
+	address     []string
+	group       string
+	producer    kafkaProducer
+	metrics     *producerMetrics
+}
+
+// produce sends a message keyed so that all messages with the same key land
+// on the same partition (and stay in order). If acknowledgements are required
+// it waits until kafka has confirmed delivery.
+func (lc *LogProducer) produce(topic string, key string, value []byte) error {
+	var deliveryChan chan kafka.Event = nil
+	if lc.AckRequired {
+		deliveryChan = make(chan kafka.Event, 1)
+	}
+	err := lc.producer.Produce(&kafka.Message{
+		TopicPartition: kafka.TopicPartition{Topic: &topic, Partition: kafka.PartitionAny},
+		Key:            []byte(key),
+		Value:          value,
+		Headers:        []kafka.Header{},
+	}, deliveryChan)
+	if err != nil {
+		atomic.AddInt64(&lc.metrics.produceErrors, 1)
+		return err
+	}
+	atomic.AddInt64(&lc.metrics.produced, 1)
+	if deliveryChan == nil {
+		return nil
+	}
+	timeout := time.NewTimer(ackTimeout + time.Second*5)
+	defer timeout.Stop()
+	select {
+	case ev := <-deliveryChan:
+		if m, ok := ev.(*kafka.Message); ok {
+			return lc.recordDelivery(m)
+		}
+		return nil
+	case <-timeout.C:
+		atomic.AddInt64(&lc.metrics.deliveryErrors, 1)
+		return errors.New("timed out waiting for delivery acknowledgement")
+	}
+}
+
+func (lc *LogProducer) recordDelivery(m *kafka.Message) error {
+	if m.TopicPartition.Error != nil {
+		atomic.AddInt64(&lc.metrics.deliveryErrors, 1)
+		return m.TopicPartition.Error
+	}
+	atomic.AddInt64(&lc.metrics.delivered, 1)
+	return nil
+}
+
+// deliveryReports tracks delivery of messages that were not waited on.
+func (lc *LogProducer) deliveryReports(producer kafkaProducer) {
+	for ev := range producer.Events() {
+		switch e := ev.(type) {
+		case *kafka.Message:
+			if err := lc.recordDelivery(e); err != nil {
+				log.Printf("[producer] Delivery failed to %s: %s\n", *e.TopicPartition.Topic, err)
+			}
+		case kafka.Error:
+			log.Printf("[producer] Error: %s\n", e)
+		}
+	}
+}
+
+func (lc *LogProducer) PrintMetrics() {
+	log.Printf("[metrics] producer count#produced=%d count#delivered=%d count#delivery_errors=%d count#produce_errors=%d\n", atomic.SwapInt64(&lc.metrics.produced, 0), atomic.SwapInt64(&lc.metrics.delivered, 0), atomic.SwapInt64(&lc.metrics.deliveryErrors, 0), atomic.SwapInt64(&lc.metrics.produceErrors, 0))
+}
+
+// partitionKey is the app a message belongs to, an app's processes (e.g.,
+// app--worker) share the app's key so all of the app's logs stay in order.
+func partitionKey(message LogSpec) string {
+	return strings.SplitN(message.Kubernetes.ContainerName, "--", 2)[0]
 }
 
 func (lc *LogProducer) AddLog(message LogSpec) error {
@@ -67,25 +189,107 @@ func (lc *LogProducer) AddLog(message LogSpec) error {
 	if err != nil {
 		return err
 	}
-	return lc.producer.Produce(&kafka.Message{
-		TopicPartition: kafka.TopicPartition{Topic: &message.Topic, Partition: kafka.PartitionAny},
-		Value:          bytes,
-		Headers:        []kafka.Header{},
-	}, nil)
+	return lc.produce(message.Topic, partitionKey(message), bytes)
+}
+
+// AddLogs produces each message, if wait is greater than zero (or
+// acknowledgements are required) it blocks until kafka acknowledges delivery
+// of every message or the wait elapses. The returned errors correspond to
+// each message, nil if it was accepted.
+func (lc *LogProducer) AddLogs(messages []LogSpec, wait time.Duration) []error {
+	var errs = make([]error, len(messages))
+	if lc.AckRequired && wait <= 0 {
+		wait = ackTimeout + time.Second*5
+	}
+	var deliveryChan chan kafka.Event = nil
+	if wait > 0 {
+		deliveryChan = make(chan kafka.Event, len(messages))
+	}
+	var pending = make(map[int]bool)
+	for i, message := range messages {
+		bytes, err := json.Marshal(message)
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+		var topic = message.Topic
+		err = lc.producer.Produce(&kafka.Message{
+			TopicPartition: kafka.TopicPartition{Topic: &topic, Partition: kafka.PartitionAny},
+			Key:            []byte(partitionKey(message)),
+			Value:          bytes,
+			Headers:        []kafka.Header{},
+			Opaque:         i,
+		}, deliveryChan)
+		if err != nil {
+			atomic.AddInt64(&lc.metrics.produceErrors, 1)
+			errs[i] = err
+			continue
+		}
+		atomic.AddInt64(&lc.metrics.produced, 1)
+		if deliveryChan != nil {
+			pending[i] = true
+		}
+	}
+	if len(pending) == 0 {
+		return errs
+	}
+	timeout := time.NewTimer(wait)
+	defer timeout.Stop()
+	for len(pending) > 0 {
+		select {
+		case ev := <-deliveryChan:
+			if m, ok := ev.(*kafka.Message); ok {
+				if i, ok := m.Opaque.(int); ok && pending[i] {
+					errs[i] = lc.recordDelivery(m)
+					delete(pending, i)
+				}
+			}
+		case <-timeout.C:
+			for i := range pending {
+				atomic.AddInt64(&lc.metrics.deliveryErrors, 1)
+				errs[i] = errors.New("timed out waiting for delivery acknowledgement")
+			}
+			return errs
+		}
+	}
+	return errs
 }
 
+// AddRaw produces a preformatted message, the key determines the partition.
+func (lc *LogProducer) AddRaw(topic string, key string, message string) error {
+	return lc.produce(topic, key, []byte(message))
+}
 
-func (lc *LogProducer) AddRaw(topic string, message string) error {
-	return lc.producer.Produce(&kafka.Message{
+// AddDeadLetter republishes a message that could not be parsed to the dead
+// letter topic, headers record where it came from and why it failed.
+func (lc *LogProducer) AddDeadLetter(topic string, source *kafka.Message, parseErr error) error {
+	var sourceTopic = ""
+	if source.TopicPartition.Topic != nil {
+		sourceTopic = *source.TopicPartition.Topic
+	}
+	err := lc.producer.Produce(&kafka.Message{
 		TopicPartition: kafka.TopicPartition{Topic: &topic, Partition: kafka.PartitionAny},
-		Value:          []byte(message),
-		Headers:        []kafka.Header{},
+		Key:            source.Key,
+		Value:          source.Value,
+		Headers: []kafka.Header{
+			{Key: "source_topic", Value: []byte(sourceTopic)},
+			{Key: "source_partition", Value: []byte(strconv.Itoa(int(source.TopicPartition.Partition)))},
+			{Key: "source_offset", Value: []byte(strconv.FormatInt(int64(source.TopicPartition.Offset), 10))},
+			{Key: "parse_error", Value: []byte(parseErr.Error())},
+		},
 	}, nil)
+	if err != nil {
+		atomic.AddInt64(&lc.metrics.produceErrors, 1)
+		return err
+	}
+	atomic.AddInt64(&lc.metrics.produced, 1)
+	return nil
 }
 
 func (lc *LogProducer) Init(kafkaAddrs []string, kafkaGroup string) error {
 	lc.address = kafkaAddrs
 	lc.group = kafkaGroup
+	lc.AckRequired = os.Getenv("KAFKA_ACK_REQUIRED") == "true"
 	return lc.Open()
 }
 
@@ -99,7 +303,11 @@ func (lc *LogProducer) Open() error {
 	if lc.group == "" {
 		return errors.New("invalid group")
 	}
-	lc.producer = CreateProducer(lc.address, lc.group)
+	if lc.metrics == nil {
+		lc.metrics = &producerMetrics{}
+	}
+	lc.producer = CreateProducer(lc.address, lc.group, lc.AckRequired)
+	go lc.deliveryReports(lc.producer)
 	lc.IsOpen = true
 	return nil
 }
@@ -108,6 +316,10 @@ func (lc *LogProducer) Close() {
 	if lc.IsOpen == false {
 		return
 	}
+	// Give any queued messages a chance to be delivered.
+	if remaining := lc.producer.Flush(10000); remaining > 0 {
+		log.Printf("[producer] %d messages were not delivered before closing\n", remaining)
+	}
 	lc.producer.Close()
 	lc.IsOpen = false
 }
@@ -0,0 +1,168 @@
+package events
+
+import (
+	"errors"
+	kafka "github.com/confluentinc/confluent-kafka-go/kafka"
+	. "github.com/smartystreets/goconvey/convey"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeProducer records what's produced instead of sending it to kafka, if a
+// delivery channel is given the message is reported as delivered (with
+// deliveryErr if set) unless undelivered.
+type fakeProducer struct {
+	messages    []*kafka.Message
+	waited      int
+	events      chan kafka.Event
+	produceErr  error
+	deliveryErr error
+	undelivered bool
+}
+
+func (p *fakeProducer) Produce(msg *kafka.Message, deliveryChan chan kafka.Event) error {
+	if p.produceErr != nil {
+		return p.produceErr
+	}
+	p.messages = append(p.messages, msg)
+	if deliveryChan != nil {
+		p.waited++
+		if !p.undelivered {
+			delivered := *msg
+			delivered.TopicPartition.Error = p.deliveryErr
+			deliveryChan <- &delivered
+		}
+	}
+	return nil
+}
+
+func (p *fakeProducer) Events() chan kafka.Event {
+	return p.events
+}
+
+func (p *fakeProducer) Flush(timeoutMs int) int {
+	return 0
+}
+
+func (p *fakeProducer) Close() {}
+
+func createTestProducer(producer kafkaProducer) *LogProducer {
+	return &LogProducer{IsOpen: true, producer: producer, metrics: &producerMetrics{}}
+}
+
+func TestDeadLetters(t *testing.T) {
+	Convey("Ensure dead letters keep the message and record where it came from and why it failed.", t, func() {
+		fake := &fakeProducer{}
+		producer := createTestProducer(fake)
+		var topic = "alamoweblogs"
+		source := &kafka.Message{TopicPartition: kafka.TopicPartition{Topic: &topic, Partition: 3, Offset: 1234567}, Key: []byte("key"), Value: []byte("not a log")}
+		So(producer.AddDeadLetter("_deadletters", source, errors.New("unable to parse log message")), ShouldEqual, nil)
+		So(len(fake.messages), ShouldEqual, 1)
+		So(*fake.messages[0].TopicPartition.Topic, ShouldEqual, "_deadletters")
+		So(string(fake.messages[0].Key), ShouldEqual, "key")
+		So(string(fake.messages[0].Value), ShouldEqual, "not a log")
+		So(fake.messages[0].Headers, ShouldResemble, []kafka.Header{
+			{Key: "source_topic", Value: []byte("alamoweblogs")},
+			{Key: "source_partition", Value: []byte("3")},
+			{Key: "source_offset", Value: []byte("1234567")},
+			{Key: "parse_error", Value: []byte("unable to parse log message")},
+		})
+		So(producer.metrics.produced, ShouldEqual, 1)
+	})
+	Convey("Ensure dead letters of messages without a topic have an empty source topic.", t, func() {
+		fake := &fakeProducer{}
+		producer := createTestProducer(fake)
+		So(producer.AddDeadLetter("_deadletters", &kafka.Message{Value: []byte("x")}, errors.New("bad")), ShouldEqual, nil)
+		So(string(fake.messages[0].Headers[0].Value), ShouldEqual, "")
+	})
+}
+
+func TestProducer(t *testing.T) {
+	var message = LogSpec{Log: "hello", Topic: "space", Time: time.Now(), Kubernetes: KubernetesSpec{ContainerName: "app--worker"}}
+	Convey("Ensure log messages are keyed by app so an app's processes share a partition.", t, func() {
+		fake := &fakeProducer{}
+		producer := createTestProducer(fake)
+		So(producer.AddLog(message), ShouldEqual, nil)
+		web := message
+		web.Kubernetes.ContainerName = "app"
+		So(producer.AddLogs([]LogSpec{message, web}, 0), ShouldResemble, []error{nil, nil})
+		So(len(fake.messages), ShouldEqual, 3)
+		for _, m := range fake.messages {
+			So(*m.TopicPartition.Topic, ShouldEqual, "space")
+			So(string(m.Key), ShouldEqual, "app")
+		}
+		So(partitionKey(LogSpec{Kubernetes: KubernetesSpec{ContainerName: "www.example.com"}}), ShouldEqual, "www.example.com")
+	})
+	Convey("Ensure messages aren't waited on unless acknowledgements are required.", t, func() {
+		fake := &fakeProducer{}
+		producer := createTestProducer(fake)
+		So(producer.AddLog(message), ShouldEqual, nil)
+		So(fake.waited, ShouldEqual, 0)
+		So(atomic.LoadInt64(&producer.metrics.produced), ShouldEqual, 1)
+		So(atomic.LoadInt64(&producer.metrics.delivered), ShouldEqual, 0)
+	})
+	Convey("Ensure messages wait for delivery when acknowledgements are required.", t, func() {
+		fake := &fakeProducer{}
+		producer := createTestProducer(fake)
+		producer.AckRequired = true
+		So(producer.AddLog(message), ShouldEqual, nil)
+		So(producer.AddLogs([]LogSpec{message, message}, 0), ShouldResemble, []error{nil, nil})
+		So(fake.waited, ShouldEqual, 3)
+		So(atomic.LoadInt64(&producer.metrics.produced), ShouldEqual, 3)
+		So(atomic.LoadInt64(&producer.metrics.delivered), ShouldEqual, 3)
+		fake.deliveryErr = errors.New("broker is down")
+		So(producer.AddLog(message), ShouldEqual, fake.deliveryErr)
+		errs := producer.AddLogs([]LogSpec{message}, 0)
+		So(errs[0], ShouldEqual, fake.deliveryErr)
+		So(atomic.LoadInt64(&producer.metrics.deliveryErrors), ShouldEqual, 2)
+	})
+	Convey("Ensure undelivered messages time out when waited on.", t, func() {
+		fake := &fakeProducer{undelivered: true}
+		producer := createTestProducer(fake)
+		errs := producer.AddLogs([]LogSpec{message, message}, time.Millisecond*10)
+		So(errs[0], ShouldNotEqual, nil)
+		So(errs[1], ShouldNotEqual, nil)
+		So(atomic.LoadInt64(&producer.metrics.deliveryErrors), ShouldEqual, 2)
+	})
+	Convey("Ensure messages kafka won't accept are counted as produce errors.", t, func() {
+		fake := &fakeProducer{produceErr: errors.New("queue is full")}
+		producer := createTestProducer(fake)
+		So(producer.AddLog(message), ShouldEqual, fake.produceErr)
+		So(producer.AddLogs([]LogSpec{message}, 0)[0], ShouldEqual, fake.produceErr)
+		So(atomic.LoadInt64(&producer.metrics.produceErrors), ShouldEqual, 2)
+		So(atomic.LoadInt64(&producer.metrics.produced), ShouldEqual, 0)
+	})
+	Convey("Ensure delivery reports of messages that weren't waited on are counted.", t, func() {
+		fake := &fakeProducer{events: make(chan kafka.Event, 3)}
+		producer := createTestProducer(fake)
+		var topic = "space"
+		fake.events <- &kafka.Message{TopicPartition: kafka.TopicPartition{Topic: &topic}}
+		fake.events <- &kafka.Message{TopicPartition: kafka.TopicPartition{Topic: &topic, Error: errors.New("message timed out")}}
+		fake.events <- kafka.NewError(kafka.ErrAllBrokersDown, "all brokers are down", false)
+		close(fake.events)
+		producer.deliveryReports(fake)
+		So(atomic.LoadInt64(&producer.metrics.delivered), ShouldEqual, 1)
+		So(atomic.LoadInt64(&producer.metrics.deliveryErrors), ShouldEqual, 1)
+		producer.PrintMetrics()
+		So(atomic.LoadInt64(&producer.metrics.delivered), ShouldEqual, 0)
+		So(atomic.LoadInt64(&producer.metrics.deliveryErrors), ShouldEqual, 0)
+	})
+	Convey("Ensure KAFKA_ACK_REQUIRED requires acknowledgement from all in-sync replicas.", t, func() {
+		config := producerConfig([]string{"kafka1:9092", "kafka2:9092"}, "logshuttle", false)
+		So(config["bootstrap.servers"], ShouldEqual, "kafka1:9092,kafka2:9092")
+		_, ok := config["acks"]
+		So(ok, ShouldEqual, false)
+		config = producerConfig([]string{"kafka1:9092"}, "logshuttle", true)
+		So(config["acks"], ShouldEqual, "all")
+		So(config["message.timeout.ms"], ShouldEqual, 30000)
+
+		os.Setenv("KAFKA_ACK_REQUIRED", "true")
+		defer os.Unsetenv("KAFKA_ACK_REQUIRED")
+		var producer LogProducer
+		So(producer.Init([]string{"localhost:9092"}, "logshuttle"), ShouldEqual, nil)
+		defer producer.Close()
+		So(producer.AckRequired, ShouldEqual, true)
+	})
+}
@@ -0,0 +1,79 @@
+package events
+
+import (
+	"fmt"
+	kafka "github.com/confluentinc/confluent-kafka-go/kafka"
+	"os"
+	"strings"
+)
+
+var saslMechanisms = map[string]bool{
+	"PLAIN":         true,
+	"SCRAM-SHA-256": true,
+	"SCRAM-SHA-512": true,
+}
+
+// SetSecurityConfig adds SASL and TLS settings for connecting to kafka from the
+// environment. The security protocol is inferred from what is set unless
+// KAFKA_SECURITY_PROTOCOL is explicitly given.
+// See: https://github.com/edenhill/librdkafka/tree/master/CONFIGURATION.md
+func SetSecurityConfig(config kafka.ConfigMap) error {
+	var mechanism = strings.ToUpper(os.Getenv("KAFKA_SASL_MECHANISM"))
+	var username = os.Getenv("KAFKA_SASL_USERNAME")
+	var password = os.Getenv("KAFKA_SASL_PASSWORD")
+	var ca = os.Getenv("KAFKA_TLS_CA")
+	var cert = os.Getenv("KAFKA_TLS_CERT")
+	var key = os.Getenv("KAFKA_TLS_KEY")
+
+	var useSasl = mechanism != "" || username != ""
+	var useTls = os.Getenv("KAFKA_TLS") == "true" || ca != "" || cert != ""
+
+	var protocol = strings.ToLower(os.Getenv("KAFKA_SECURITY_PROTOCOL"))
+	if protocol == "" {
+		if useSasl && useTls {
+			protocol = "sasl_ssl"
+		} else if useSasl {
+			protocol = "sasl_plaintext"
+		} else if useTls {
+			protocol = "ssl"
+		} else {
+			return nil
+		}
+	}
+	if protocol != "plaintext" && protocol != "ssl" && protocol != "sasl_plaintext" && protocol != "sasl_ssl" {
+		return fmt.Errorf("Unknown kafka security protocol %s", protocol)
+	}
+	config.SetKey("security.protocol", protocol)
+
+	if strings.HasPrefix(protocol, "sasl_") {
+		if mechanism == "" {
+			mechanism = "PLAIN"
+		}
+		if _, ok := saslMechanisms[mechanism]; !ok {
+			return fmt.Errorf("Unsupported kafka sasl mechanism %s", mechanism)
+		}
+		if username == "" || password == "" {
+			return fmt.Errorf("KAFKA_SASL_USERNAME and KAFKA_SASL_PASSWORD must be set to use sasl")
+		}
+		config.SetKey("sasl.mechanisms", mechanism)
+		config.SetKey("sasl.username", username)
+		config.SetKey("sasl.password", password)
+	}
+
+	if strings.HasSuffix(protocol, "ssl") {
+		if ca != "" {
+			config.SetKey("ssl.ca.location", ca)
+		}
+		if (cert == "") != (key == "") {
+			return fmt.Errorf("KAFKA_TLS_CERT and KAFKA_TLS_KEY must both be set to use a client certificate")
+		}
+		if cert != "" {
+			config.SetKey("ssl.certificate.location", cert)
+			config.SetKey("ssl.key.location", key)
+			if os.Getenv("KAFKA_TLS_KEY_PASSWORD") != "" {
+				config.SetKey("ssl.key.password", os.Getenv("KAFKA_TLS_KEY_PASSWORD"))
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,66 @@
+package events
+
+import (
+	kafka "github.com/confluentinc/confluent-kafka-go/kafka"
+	. "github.com/smartystreets/goconvey/convey"
+	"os"
+	"testing"
+)
+
+var securityEnv = []string{"KAFKA_SECURITY_PROTOCOL", "KAFKA_SASL_MECHANISM", "KAFKA_SASL_USERNAME", "KAFKA_SASL_PASSWORD", "KAFKA_TLS", "KAFKA_TLS_CA", "KAFKA_TLS_CERT", "KAFKA_TLS_KEY", "KAFKA_TLS_KEY_PASSWORD"}
+
+func TestSetSecurityConfig(t *testing.T) {
+	Convey("Ensure kafka security settings are taken from the environment.", t, func() {
+		var tests = []struct {
+			name   string
+			env    map[string]string
+			config kafka.ConfigMap
+			err    bool
+		}{
+			{"nothing set", map[string]string{}, kafka.ConfigMap{}, false},
+			{"sasl plain by default", map[string]string{"KAFKA_SASL_USERNAME": "user", "KAFKA_SASL_PASSWORD": "pass"},
+				kafka.ConfigMap{"security.protocol": "sasl_plaintext", "sasl.mechanisms": "PLAIN", "sasl.username": "user", "sasl.password": "pass"}, false},
+			{"sasl scram", map[string]string{"KAFKA_SASL_MECHANISM": "scram-sha-512", "KAFKA_SASL_USERNAME": "user", "KAFKA_SASL_PASSWORD": "pass"},
+				kafka.ConfigMap{"security.protocol": "sasl_plaintext", "sasl.mechanisms": "SCRAM-SHA-512", "sasl.username": "user", "sasl.password": "pass"}, false},
+			{"sasl scram over tls", map[string]string{"KAFKA_SASL_MECHANISM": "SCRAM-SHA-256", "KAFKA_SASL_USERNAME": "user", "KAFKA_SASL_PASSWORD": "pass", "KAFKA_TLS": "true"},
+				kafka.ConfigMap{"security.protocol": "sasl_ssl", "sasl.mechanisms": "SCRAM-SHA-256", "sasl.username": "user", "sasl.password": "pass"}, false},
+			{"unknown sasl mechanism", map[string]string{"KAFKA_SASL_MECHANISM": "GSSAPI", "KAFKA_SASL_USERNAME": "user", "KAFKA_SASL_PASSWORD": "pass"}, nil, true},
+			{"sasl without a password", map[string]string{"KAFKA_SASL_USERNAME": "user"}, nil, true},
+			{"tls with system cas", map[string]string{"KAFKA_TLS": "true"}, kafka.ConfigMap{"security.protocol": "ssl"}, false},
+			{"tls with a ca", map[string]string{"KAFKA_TLS_CA": "/etc/kafka/ca.pem"},
+				kafka.ConfigMap{"security.protocol": "ssl", "ssl.ca.location": "/etc/kafka/ca.pem"}, false},
+			{"tls with a client certificate", map[string]string{"KAFKA_TLS_CA": "/etc/kafka/ca.pem", "KAFKA_TLS_CERT": "/etc/kafka/cert.pem", "KAFKA_TLS_KEY": "/etc/kafka/key.pem", "KAFKA_TLS_KEY_PASSWORD": "secret"},
+				kafka.ConfigMap{"security.protocol": "ssl", "ssl.ca.location": "/etc/kafka/ca.pem", "ssl.certificate.location": "/etc/kafka/cert.pem", "ssl.key.location": "/etc/kafka/key.pem", "ssl.key.password": "secret"}, false},
+			{"tls with a client certificate and no key", map[string]string{"KAFKA_TLS_CERT": "/etc/kafka/cert.pem"}, nil, true},
+			{"tls with a key and no client certificate", map[string]string{"KAFKA_TLS": "true", "KAFKA_TLS_KEY": "/etc/kafka/key.pem"}, nil, true},
+			{"explicit protocol", map[string]string{"KAFKA_SECURITY_PROTOCOL": "SSL", "KAFKA_TLS_CA": "/etc/kafka/ca.pem"},
+				kafka.ConfigMap{"security.protocol": "ssl", "ssl.ca.location": "/etc/kafka/ca.pem"}, false},
+			{"explicit plaintext ignores tls settings", map[string]string{"KAFKA_SECURITY_PROTOCOL": "plaintext", "KAFKA_TLS_CA": "/etc/kafka/ca.pem"},
+				kafka.ConfigMap{"security.protocol": "plaintext"}, false},
+			{"unknown protocol", map[string]string{"KAFKA_SECURITY_PROTOCOL": "kerberos"}, nil, true},
+		}
+		for _, test := range tests {
+			Convey(test.name, func() {
+				for _, name := range securityEnv {
+					os.Unsetenv(name)
+				}
+				for name, value := range test.env {
+					os.Setenv(name, value)
+				}
+				defer func() {
+					for name := range test.env {
+						os.Unsetenv(name)
+					}
+				}()
+				config := kafka.ConfigMap{}
+				err := SetSecurityConfig(config)
+				if test.err {
+					So(err, ShouldNotEqual, nil)
+					return
+				}
+				So(err, ShouldEqual, nil)
+				So(config, ShouldResemble, test.config)
+			})
+		}
+	})
+}
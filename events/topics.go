@@ -0,0 +1,88 @@
+package events
+
+import (
+	"log"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// TopicConfig describes which kafka topics contain which kinds of logs. Every
+// topic that isn't a web, istio or build log topic and matches the app include
+// (and not the app exclude) pattern is treated as a space's app logs.
+type TopicConfig struct {
+	WebLogs      string
+	IstioWebLogs string
+	BuildLogs    string
+	AppInclude   *regexp.Regexp
+	AppExclude   *regexp.Regexp
+}
+
+var topicConfig *TopicConfig
+var topicConfigOnce sync.Once
+
+func getenvOrDefault(name string, def string) string {
+	if val := os.Getenv(name); val != "" {
+		return val
+	}
+	return def
+}
+
+// LoadTopicConfig reads the topic configuration from the environment.
+func LoadTopicConfig() (*TopicConfig, error) {
+	include, err := regexp.Compile(getenvOrDefault("KAFKA_APP_TOPICS_INCLUDE", "^.*$"))
+	if err != nil {
+		return nil, err
+	}
+	var exclude *regexp.Regexp = nil
+	if os.Getenv("KAFKA_APP_TOPICS_EXCLUDE") != "-" {
+		if exclude, err = regexp.Compile(getenvOrDefault("KAFKA_APP_TOPICS_EXCLUDE", "^_")); err != nil {
+			return nil, err
+		}
+	}
+	return &TopicConfig{
+		WebLogs:      getenvOrDefault("KAFKA_WEB_LOGS_TOPIC", "alamoweblogs"),
+		IstioWebLogs: getenvOrDefault("KAFKA_ISTIO_LOGS_TOPIC", "istio-access-logs"),
+		BuildLogs:    getenvOrDefault("KAFKA_BUILD_LOGS_TOPIC", "alamobuildlogs"),
+		AppInclude:   include,
+		AppExclude:   exclude,
+	}, nil
+}
+
+// Topics returns the topic configuration, loaded once from the environment.
+func Topics() *TopicConfig {
+	topicConfigOnce.Do(func() {
+		tc, err := LoadTopicConfig()
+		if err != nil {
+			log.Fatalf("Fatal: Invalid kafka topic configuration: %s\n", err)
+		}
+		topicConfig = tc
+	})
+	return topicConfig
+}
+
+// IsAppTopic returns whether the topic contains app logs.
+func (tc *TopicConfig) IsAppTopic(topic string) bool {
+	if topic == tc.WebLogs || topic == tc.IstioWebLogs || topic == tc.BuildLogs {
+		return false
+	}
+	if tc.AppExclude != nil && tc.AppExclude.MatchString(topic) {
+		return false
+	}
+	return tc.AppInclude.MatchString(topic)
+}
+
+// AppSubscription returns the topic pattern to subscribe to for app logs.
+func (tc *TopicConfig) AppSubscription() string {
+	var pattern = tc.AppInclude.String()
+	if !strings.HasPrefix(pattern, "^") {
+		pattern = "^.*" + pattern
+	}
+	return pattern
+}
+
+// Subscription returns the topics (and topic patterns) to subscribe to.
+func (tc *TopicConfig) Subscription() []string {
+	return []string{tc.AppSubscription(), tc.WebLogs, tc.IstioWebLogs, tc.BuildLogs}
+}
@@ -0,0 +1,135 @@
+package events
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"os"
+	"testing"
+)
+
+var topicsEnv = []string{"KAFKA_WEB_LOGS_TOPIC", "KAFKA_ISTIO_LOGS_TOPIC", "KAFKA_BUILD_LOGS_TOPIC", "KAFKA_APP_TOPICS_INCLUDE", "KAFKA_APP_TOPICS_EXCLUDE"}
+
+// withTopicsEnv sets only the given topic settings while fn runs.
+func withTopicsEnv(env map[string]string, fn func()) {
+	for _, name := range topicsEnv {
+		os.Unsetenv(name)
+	}
+	for name, value := range env {
+		os.Setenv(name, value)
+	}
+	defer func() {
+		for name := range env {
+			os.Unsetenv(name)
+		}
+	}()
+	fn()
+}
+
+func TestLoadTopicConfig(t *testing.T) {
+	Convey("Ensure the topic configuration is taken from the environment.", t, func() {
+		var tests = []struct {
+			name         string
+			env          map[string]string
+			web          string
+			istio        string
+			build        string
+			include      string
+			exclude      string
+			subscription []string
+		}{
+			{"defaults", map[string]string{}, "alamoweblogs", "istio-access-logs", "alamobuildlogs", "^.*$", "^_",
+				[]string{"^.*$", "alamoweblogs", "istio-access-logs", "alamobuildlogs"}},
+			{"renamed topics", map[string]string{"KAFKA_WEB_LOGS_TOPIC": "weblogs", "KAFKA_ISTIO_LOGS_TOPIC": "istiologs", "KAFKA_BUILD_LOGS_TOPIC": "buildlogs"}, "weblogs", "istiologs", "buildlogs", "^.*$", "^_",
+				[]string{"^.*$", "weblogs", "istiologs", "buildlogs"}},
+			{"anchored app include", map[string]string{"KAFKA_APP_TOPICS_INCLUDE": "^apps-.*$", "KAFKA_APP_TOPICS_EXCLUDE": "-test$"}, "alamoweblogs", "istio-access-logs", "alamobuildlogs", "^apps-.*$", "-test$",
+				[]string{"^apps-.*$", "alamoweblogs", "istio-access-logs", "alamobuildlogs"}},
+			{"unanchored app include", map[string]string{"KAFKA_APP_TOPICS_INCLUDE": "-apps$"}, "alamoweblogs", "istio-access-logs", "alamobuildlogs", "-apps$", "^_",
+				[]string{"^.*-apps$", "alamoweblogs", "istio-access-logs", "alamobuildlogs"}},
+			{"no app exclude", map[string]string{"KAFKA_APP_TOPICS_EXCLUDE": "-"}, "alamoweblogs", "istio-access-logs", "alamobuildlogs", "^.*$", "",
+				[]string{"^.*$", "alamoweblogs", "istio-access-logs", "alamobuildlogs"}},
+		}
+		for _, test := range tests {
+			Convey(test.name, func() {
+				withTopicsEnv(test.env, func() {
+					tc, err := LoadTopicConfig()
+					So(err, ShouldEqual, nil)
+					So(tc.WebLogs, ShouldEqual, test.web)
+					So(tc.IstioWebLogs, ShouldEqual, test.istio)
+					So(tc.BuildLogs, ShouldEqual, test.build)
+					So(tc.AppInclude.String(), ShouldEqual, test.include)
+					if test.exclude == "" {
+						So(tc.AppExclude, ShouldBeNil)
+					} else {
+						So(tc.AppExclude.String(), ShouldEqual, test.exclude)
+					}
+					So(tc.Subscription(), ShouldResemble, test.subscription)
+					So(tc.AppSubscription(), ShouldEqual, test.subscription[0])
+				})
+			})
+		}
+	})
+	Convey("Ensure invalid app topic patterns are rejected.", t, func() {
+		var tests = []map[string]string{
+			{"KAFKA_APP_TOPICS_INCLUDE": "apps-("},
+			{"KAFKA_APP_TOPICS_EXCLUDE": "[_"},
+		}
+		for _, env := range tests {
+			withTopicsEnv(env, func() {
+				tc, err := LoadTopicConfig()
+				So(err, ShouldNotEqual, nil)
+				So(tc, ShouldBeNil)
+			})
+		}
+	})
+}
+
+func TestIsAppTopic(t *testing.T) {
+	Convey("Ensure only app topics are classified as app logs.", t, func() {
+		var tests = []struct {
+			name   string
+			env    map[string]string
+			topics map[string]bool
+		}{
+			{"defaults", map[string]string{}, map[string]bool{
+				"space":             true,
+				"default":           true,
+				"alamoweblogs":      false,
+				"istio-access-logs": false,
+				"alamobuildlogs":    false,
+				"_deadletters":      false,
+			}},
+			{"renamed router and build topics", map[string]string{"KAFKA_WEB_LOGS_TOPIC": "weblogs", "KAFKA_BUILD_LOGS_TOPIC": "buildlogs"}, map[string]bool{
+				"weblogs":        false,
+				"buildlogs":      false,
+				"alamoweblogs":   true,
+				"alamobuildlogs": true,
+			}},
+			{"include and exclude", map[string]string{"KAFKA_APP_TOPICS_INCLUDE": "^apps-", "KAFKA_APP_TOPICS_EXCLUDE": "-test$"}, map[string]bool{
+				"apps-space":      true,
+				"apps-space-test": false,
+				"space":           false,
+				"_apps-space":     false,
+			}},
+			{"router topics matching the include", map[string]string{"KAFKA_APP_TOPICS_INCLUDE": "logs$"}, map[string]bool{
+				"applogs":           true,
+				"alamoweblogs":      false,
+				"alamobuildlogs":    false,
+				"istio-access-logs": false,
+			}},
+			{"no app exclude", map[string]string{"KAFKA_APP_TOPICS_EXCLUDE": "-"}, map[string]bool{
+				"_deadletters": true,
+				"alamoweblogs": false,
+			}},
+		}
+		for _, test := range tests {
+			Convey(test.name, func() {
+				withTopicsEnv(test.env, func() {
+					tc, err := LoadTopicConfig()
+					So(err, ShouldEqual, nil)
+					for topic, app := range test.topics {
+						So(tc.IsAppTopic(topic), ShouldEqual, app)
+					}
+				})
+			})
+		}
+	})
+}
@@ -25,4 +25,5 @@ require (
 	gopkg.in/bsm/ratelimit.v1 v1.0.0-20160220154919-db14e161995a
 	gopkg.in/mcuadros/go-syslog.v2 v2.3.0
 	gopkg.in/redis.v4 v4.2.4
+	gopkg.in/yaml.v2 v2.4.0
 )
@@ -45,8 +45,15 @@ func ReadLogSession(client *storage.Storage, kafkaAddrs []string) func(http.Resp
 			res.WriteHeader(http.StatusNotFound)
 			return
 		}
+		redactor, err := shuttle.LoadRedactor(client)
+		if err != nil {
+			log.Printf("Unable to load redaction rules: %s\n", err)
+			res.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
 		res.WriteHeader(http.StatusOK)
 		var ls shuttle.Session
+		ls.Redactor = redactor
 		ls.ConsumeAndRespond(kafkaAddrs, logSess.App, logSess.Space, logSess.Site, req, res)
 	}
 }
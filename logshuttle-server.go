@@ -1,20 +1,29 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
 	"github.com/akkeris/logshuttle/drains"
 	"github.com/akkeris/logshuttle/events"
 	"github.com/akkeris/logshuttle/shuttle"
 	"github.com/akkeris/logshuttle/storage"
+	"github.com/akkeris/logshuttle/syslog"
+	"github.com/akkeris/logshuttle/urls"
 	"github.com/go-martini/martini"
 	"github.com/martini-contrib/binding"
 	"github.com/martini-contrib/render"
 	"github.com/nu7hatch/gouuid"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"io"
+	"io/ioutil"
 	"net/http/pprof"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"regexp"
 	"strconv"
 	"strings"
 	"syscall"
@@ -26,8 +35,32 @@ type addonResponse struct {
 	Name string `json:"name"`
 }
 
+// logDrainCreateRequest adds a drain, it's removed once expires_at (or the ttl,
+// a duration such as 72h) passes if either is given.
 type logDrainCreateRequest struct {
-	Url string `json:"url"`
+	Url       string                `json:"url"`
+	Filters   *storage.RouteFilters `json:"filters,omitempty"`
+	ExpiresAt *time.Time            `json:"expires_at,omitempty"`
+	Ttl       string                `json:"ttl,omitempty"`
+}
+
+// expires returns when the drain expires, nil if it doesn't.
+func (opts logDrainCreateRequest) expires(now time.Time) (*time.Time, error) {
+	if opts.ExpiresAt != nil && opts.Ttl != "" {
+		return nil, errors.New("Only one of expires_at or ttl can be given")
+	}
+	if opts.Ttl != "" {
+		ttl, err := time.ParseDuration(opts.Ttl)
+		if err != nil || ttl <= 0 {
+			return nil, errors.New("The ttl must be a positive duration such as 72h")
+		}
+		expires := now.Add(ttl)
+		return &expires, nil
+	}
+	if opts.ExpiresAt != nil && !opts.ExpiresAt.After(now) {
+		return nil, errors.New("The expires_at time must be in the future")
+	}
+	return opts.ExpiresAt, nil
 }
 
 type logDrainResponse struct {
@@ -37,117 +70,358 @@ type logDrainResponse struct {
 	Token     string        `json:"token"`
 	UpdatedAt time.Time     `json:"updated_at"`
 	Url       string        `json:"url"`
+	Filters   *storage.RouteFilters `json:"filters,omitempty"`
+	ExpiresAt *time.Time            `json:"expires_at,omitempty"`
+}
+
+// drainResponse describes the route, credentials in the url are redacted
+// unless ?reveal=true is passed.
+func drainResponse(req *http.Request, key string, route *storage.Route) logDrainResponse {
+	var url = route.DestinationUrl
+	if req.URL.Query().Get("reveal") != "true" {
+		url = urls.Redact(url)
+	}
+	return logDrainResponse{Addon: addonResponse{Id: "", Name: ""}, CreatedAt: route.Created, UpdatedAt: route.Updated, Id: route.Id, Token: key, Url: url, Filters: route.Filters, ExpiresAt: route.Expires}
+}
+
+// routeForKey returns a route of the kind for the key in the url, an app-space
+// for app routes, a site or a space. False is returned if the key is invalid.
+func routeForKey(kind string, key string) (storage.Route, bool) {
+	switch kind {
+	case storage.RouteKindSite:
+		return storage.Route{Site: key}, key != ""
+	case storage.RouteKindSpace:
+		return storage.Route{Space: key}, key != ""
+	default:
+		app, space := appAndSpace(key)
+		return storage.Route{App: app, Space: space}, app != "" && space != ""
+	}
+}
+
+// routeMatchesKey checks the route belongs to the key in the url.
+func routeMatchesKey(route *storage.Route, kind string, key string) bool {
+	expected, ok := routeForKey(kind, key)
+	return ok && route.GetRouteKey() == expected.GetRouteKey()
 }
 
-func CreateLogDrain(client *storage.Storage, isSite bool) func(martini.Params, logDrainCreateRequest, binding.Errors, render.Render) {
-	return func(params martini.Params, opts logDrainCreateRequest, berr binding.Errors, r render.Render) {
+// requestCaller is the address the request came from, X-Forwarded-For is set
+// by the client so it's only recorded alongside it.
+func requestCaller(req *http.Request) string {
+	if host, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		return host
+	}
+	return req.RemoteAddr
+}
+
+// drainChangeMessage describes a change to a drain for the app's logs.
+func drainChangeMessage(audit storage.RouteAudit) string {
+	var message string
+	switch audit.Action {
+	case storage.RouteAdded:
+		message = "Added log drain " + audit.After.DestinationUrl
+	case storage.RouteUpdated:
+		message = "Updated log drain " + audit.After.DestinationUrl
+	case storage.RouteExpired:
+		message = "Removed log drain " + audit.Before.DestinationUrl + " as it expired"
+	default:
+		message = "Removed log drain " + audit.Before.DestinationUrl
+	}
+	if audit.Actor != "" {
+		message = message + " by " + audit.Actor
+	}
+	return message
+}
+
+// auditDrainChange records a change to a drain made through the api along with
+// who made it (the X-Username header).
+func auditDrainChange(client *storage.Storage, producer *events.LogProducer, req *http.Request, action string, before *storage.Route, after *storage.Route) {
+	recordDrainChange(client, producer, action, req.Header.Get("X-Username"), requestCaller(req), req.Header.Get("X-Forwarded-For"), before, after)
+}
+
+// recordDrainChange records a change to a drain in its history and, for app
+// drains, adds a line to the app's logs so its owners notice unexpected
+// drains. The change has already been made so failures are only logged.
+func recordDrainChange(client *storage.Storage, producer *events.LogProducer, action string, actor string, caller string, forwardedFor string, before *storage.Route, after *storage.Route) {
+	audit, err := storage.NewRouteAudit(action, actor, caller, before, after)
+	if err != nil {
+		log.Printf("[audit] Unable to create an audit for a drain that was %s: %s\n", action, err)
+		return
+	}
+	audit.ForwardedFor = forwardedFor
+	if err = (*client).AddRouteAudit(audit); err != nil {
+		log.Printf("[audit] Unable to record drain %s was %s: %s\n", audit.Drain, action, err)
+	}
+	if audit.GetRouteKey().Kind != storage.RouteKindApp {
+		return
+	}
+	err = producer.AddLog(events.LogSpec{
+		Log:    drainChangeMessage(audit),
+		Stream: "stdout",
+		Time:   audit.Created,
+		Space:  audit.Space,
+		Topic:  audit.Space,
+		Kubernetes: events.KubernetesSpec{
+			NamespaceName: audit.Space,
+			PodName:       "akkeris/logshuttle",
+			ContainerName: audit.App,
+		},
+	})
+	if err != nil {
+		log.Printf("[audit] Unable to add a log line for drain %s: %s\n", audit.Drain, err)
+	}
+}
+
+func CreateLogDrain(client *storage.Storage, producer *events.LogProducer, kind string) func(martini.Params, logDrainCreateRequest, binding.Errors, render.Render, *http.Request) {
+	return func(params martini.Params, opts logDrainCreateRequest, berr binding.Errors, r render.Render, req *http.Request) {
 		if berr != nil {
 			ReportInvalidRequest(r)
 			return
 		}
-		if params["key"] == "" {
+		route, ok := routeForKey(kind, params["key"])
+		if !ok {
 			ReportInvalidRequest(r)
 			return
 		}
+		if opts.Filters != nil {
+			if err := opts.Filters.Validate(); err != nil {
+				r.JSON(http.StatusUnprocessableEntity, map[string]interface{}{"message": err.Error()})
+				return
+			}
+		}
+		var now = time.Now()
+		expires, err := opts.expires(now)
+		if err != nil {
+			r.JSON(http.StatusUnprocessableEntity, map[string]interface{}{"message": err.Error()})
+			return
+		}
 		id, err := uuid.NewV4()
 		if err != nil {
 			ReportError(r, err)
 			return
 		}
-		if isSite {
-			err = (*client).AddRoute(storage.Route{Id: id.String(), Site: params["key"], Space: "", App: "", DestinationUrl: opts.Url, Created: time.Now(), Updated: time.Now()})
-		} else {
-			var app_keys = strings.SplitN(params["key"], "-", 2)
-			var app = app_keys[0]
-			var space = app_keys[1]
-			if app == "" || space == "" {
-				ReportInvalidRequest(r)
+		route.Id = id.String()
+		route.DestinationUrl = opts.Url
+		route.Filters = opts.Filters
+		route.Expires = expires
+		route.Created = now
+		route.Updated = now
+		if err = (*client).AddRoute(route); err != nil {
+			ReportError(r, err)
+			return
+		}
+		auditDrainChange(client, producer, req, storage.RouteAdded, nil, &route)
+		r.JSON(201, drainResponse(req, params["key"], &route))
+	}
+}
+
+// logDrainUpdateRequest changes a drain, fields that are left out are unchanged.
+type logDrainUpdateRequest struct {
+	Url     string                `json:"url,omitempty"`
+	Filters *storage.RouteFilters `json:"filters,omitempty"`
+}
+
+func UpdateLogDrain(client *storage.Storage, producer *events.LogProducer, kind string) func(martini.Params, logDrainUpdateRequest, binding.Errors, render.Render, *http.Request) {
+	return func(params martini.Params, opts logDrainUpdateRequest, berr binding.Errors, r render.Render, req *http.Request) {
+		if berr != nil {
+			ReportInvalidRequest(r)
+			return
+		}
+		var route, err = (*client).GetRouteById(params["id"])
+		if err != nil || !routeMatchesKey(route, kind, params["key"]) {
+			r.JSON(http.StatusNotFound, map[string]interface{}{"message": "No such log drain or app found"})
+			return
+		}
+		var before = *route
+		if opts.Filters != nil {
+			if err := opts.Filters.Validate(); err != nil {
+				r.JSON(http.StatusUnprocessableEntity, map[string]interface{}{"message": err.Error()})
 				return
 			}
-			err = (*client).AddRoute(storage.Route{Id: id.String(), Space: space, App: app, DestinationUrl: opts.Url, Created: time.Now(), Updated: time.Now()})
+			route.Filters = opts.Filters
 		}
-		if err != nil {
+		if opts.Url != "" {
+			route.DestinationUrl = opts.Url
+		}
+		route.Updated = time.Now()
+		if err = (*client).UpdateRoute(*route); err != nil {
 			ReportError(r, err)
 			return
 		}
-		r.JSON(201, logDrainResponse{Addon: addonResponse{Id: "", Name: ""}, CreatedAt: time.Now(), UpdatedAt: time.Now(), Id: id.String(), Token: params["key"], Url: opts.Url})
+		auditDrainChange(client, producer, req, storage.RouteUpdated, &before, route)
+		r.JSON(http.StatusOK, drainResponse(req, params["key"], route))
 	}
 }
 
-func DeleteLogDrain(client *storage.Storage, isSite bool) func(martini.Params, render.Render) {
-	return func(params martini.Params, r render.Render) {
+func DeleteLogDrain(client *storage.Storage, producer *events.LogProducer, kind string) func(martini.Params, render.Render, *http.Request) {
+	return func(params martini.Params, r render.Render, req *http.Request) {
 		if params["key"] == "" {
 			ReportInvalidRequest(r)
 			return
 		}
 		var route, err = (*client).GetRouteById(params["id"])
+		if err != nil || !routeMatchesKey(route, kind, params["key"]) {
+			r.JSON(http.StatusNotFound, map[string]interface{}{"message": "No such log drain or app found"})
+			return
+		}
 		err = (*client).RemoveRoute(*route)
+		if err == storage.ErrRouteNotFound {
+			r.JSON(http.StatusNotFound, map[string]interface{}{"message": "No such log drain or app found"})
+			return
+		}
 		if err != nil {
 			ReportError(r, err)
 			return
 		}
+		auditDrainChange(client, producer, req, storage.RouteRemoved, route, nil)
 
-		r.JSON(http.StatusOK, logDrainResponse{Addon: addonResponse{Id: "", Name: ""}, CreatedAt: route.Created, UpdatedAt: route.Updated, Id: route.Id, Token: params["key"], Url: route.DestinationUrl})
+		r.JSON(http.StatusOK, drainResponse(req, params["key"], route))
 	}
 }
 
-func GetLogDrain(client *storage.Storage, isSite bool) func(martini.Params, render.Render) {
-	return func(params martini.Params, r render.Render) {
+func GetLogDrain(client *storage.Storage, kind string) func(martini.Params, render.Render, *http.Request) {
+	return func(params martini.Params, r render.Render, req *http.Request) {
 		if params["key"] == "" {
 			ReportInvalidRequest(r)
 			return
 		}
 
 		var route, err = (*client).GetRouteById(params["id"])
-		if err != nil {
+		if err != nil || !routeMatchesKey(route, kind, params["key"]) {
 			r.JSON(http.StatusNotFound, map[string]interface{}{"message": "No such log drain or app found"})
 			return
 		}
-		if params["key"] != route.Site && params["key"] != (route.App+"-"+route.Space) {
-			r.JSON(http.StatusNotFound, map[string]interface{}{"message": "No such log drain or app found"})
-			return
-		}
-		r.JSON(http.StatusOK, logDrainResponse{Addon: addonResponse{Id: "", Name: ""}, CreatedAt: route.Created, UpdatedAt: route.Updated, Id: route.Id, Token: params["key"], Url: route.DestinationUrl})
+		r.JSON(http.StatusOK, drainResponse(req, params["key"], route))
 	}
 }
 
-func ListLogDrains(client *storage.Storage, isSite bool) func(martini.Params, render.Render) {
-	return func(params martini.Params, rr render.Render) {
-		if params["key"] == "" {
+func ListLogDrains(client *storage.Storage, kind string) func(martini.Params, render.Render, *http.Request) {
+	return func(params martini.Params, rr render.Render, req *http.Request) {
+		route, ok := routeForKey(kind, params["key"])
+		if !ok {
 			ReportInvalidRequest(rr)
 			return
 		}
 
-		routes_pkg, err := (*client).GetRoutes()
+		routes_pkg, err := (*client).GetRoutesByKey(route.GetRouteKey())
 		if err != nil {
 			ReportError(rr, err)
 			return
 		}
 
 		var resp = make([]logDrainResponse, 0)
-		if !isSite {
-			var app_keys = strings.SplitN(params["key"], "-", 2)
-			var app = app_keys[0]
-			var space = app_keys[1]
-			if app == "" || space == "" {
-				ReportInvalidRequest(rr)
-				return
-			}
-			for _, r := range routes_pkg {
-				if r.App == app && r.Space == space {
-					var n = logDrainResponse{Addon: addonResponse{Id: "", Name: ""}, CreatedAt: r.Created, UpdatedAt: r.Updated, Id: r.Id, Token: app + "-" + space, Url: r.DestinationUrl}
-					resp = append(resp, n)
+		for _, r := range routes_pkg {
+			resp = append(resp, drainResponse(req, params["key"], &r))
+		}
+		rr.JSON(http.StatusOK, resp)
+	}
+}
+
+// ListLogDrainHistory returns the changes to the drains of an app, site or
+// space, newest first.
+func ListLogDrainHistory(client *storage.Storage, kind string) func(martini.Params, render.Render) {
+	return func(params martini.Params, r render.Render) {
+		route, ok := routeForKey(kind, params["key"])
+		if !ok {
+			ReportInvalidRequest(r)
+			return
+		}
+		audits, err := (*client).GetRouteAudits(route.GetRouteKey())
+		if err != nil {
+			ReportError(r, err)
+			return
+		}
+		r.JSON(http.StatusOK, audits)
+	}
+}
+
+type redactionCreateRequest struct {
+	Pattern     string `json:"pattern"`
+	Replacement string `json:"replacement"`
+}
+
+// appAndSpace splits an app key (app-space) into its app and space.
+func appAndSpace(key string) (string, string) {
+	var app_keys = strings.SplitN(key, "-", 2)
+	if len(app_keys) != 2 {
+		return app_keys[0], ""
+	}
+	return app_keys[0], app_keys[1]
+}
+
+func CreateRedactionRule(client *storage.Storage) func(martini.Params, redactionCreateRequest, binding.Errors, render.Render) {
+	return func(params martini.Params, opts redactionCreateRequest, berr binding.Errors, r render.Render) {
+		if berr != nil {
+			ReportInvalidRequest(r)
+			return
+		}
+		app, space := appAndSpace(params["key"])
+		if app == "" || space == "" || opts.Pattern == "" {
+			ReportInvalidRequest(r)
+			return
+		}
+		if _, err := regexp.Compile(opts.Pattern); err != nil {
+			r.JSON(http.StatusUnprocessableEntity, map[string]interface{}{"message": "Invalid pattern: " + err.Error()})
+			return
+		}
+		id, err := uuid.NewV4()
+		if err != nil {
+			ReportError(r, err)
+			return
+		}
+		var rule = storage.RedactionRule{Id: id.String(), App: app, Space: space, Pattern: opts.Pattern, Replacement: opts.Replacement, Created: time.Now()}
+		if err = (*client).AddRedactionRule(rule); err != nil {
+			ReportError(r, err)
+			return
+		}
+		r.JSON(http.StatusCreated, rule)
+	}
+}
+
+func DeleteRedactionRule(client *storage.Storage) func(martini.Params, render.Render) {
+	return func(params martini.Params, r render.Render) {
+		app, space := appAndSpace(params["key"])
+		rules, err := (*client).GetRedactionRules()
+		if err != nil {
+			ReportError(r, err)
+			return
+		}
+		for _, rule := range rules {
+			if rule.Id == params["id"] && rule.App == app && rule.Space == space {
+				err = (*client).RemoveRedactionRule(rule)
+				if err == storage.ErrRedactionRuleNotFound {
+					break
 				}
-			}
-		} else {
-			for _, r := range routes_pkg {
-				if params["key"] == r.Site {
-					var n = logDrainResponse{Addon: addonResponse{Id: "", Name: ""}, CreatedAt: r.Created, UpdatedAt: r.Updated, Id: r.Id, Token: r.Site, Url: r.DestinationUrl}
-					resp = append(resp, n)
+				if err != nil {
+					ReportError(r, err)
+					return
 				}
+				r.JSON(http.StatusOK, rule)
+				return
 			}
 		}
-		rr.JSON(http.StatusOK, resp)
+		r.JSON(http.StatusNotFound, map[string]interface{}{"message": "No such redaction rule or app found"})
+	}
+}
+
+func ListRedactionRules(client *storage.Storage) func(martini.Params, render.Render) {
+	return func(params martini.Params, r render.Render) {
+		app, space := appAndSpace(params["key"])
+		if app == "" || space == "" {
+			ReportInvalidRequest(r)
+			return
+		}
+		rules, err := (*client).GetRedactionRules()
+		if err != nil {
+			ReportError(r, err)
+			return
+		}
+		var resp = make([]storage.RedactionRule, 0)
+		for _, rule := range rules {
+			if rule.App == app && rule.Space == space {
+				resp = append(resp, rule)
+			}
+		}
+		r.JSON(http.StatusOK, resp)
 	}
 }
 
@@ -159,13 +433,19 @@ func StartShuttleServices(client *storage.Storage, kafkaAddrs []string, port int
 	drains.Init()
 
 	var logShuttle shuttle.Shuttle
+	logShuttle.OnRouteExpired(func(route storage.Route) {
+		recordDrainChange(client, &logProducer, storage.RouteExpired, "", "", "", &route, nil)
+	})
 	logShuttle.Init(client, kafkaAddrs, kafkaGroup)
 	if os.Getenv("TEST_MODE") != "" {
 		logShuttle.EnableTestMode()
 	}
+	if os.Getenv("KAFKA_DEAD_LETTER_TOPIC") != "" {
+		logShuttle.EnableDeadLetters(&logProducer, os.Getenv("KAFKA_DEAD_LETTER_TOPIC"))
+	}
 
 	// Start http services
-	go StartHttpShuttleServices(client, logProducer, port)
+	go StartHttpShuttleServices(client, logProducer, &logShuttle, port)
 	t := time.NewTicker(time.Second * 60)
 
 	var envoyAlsAdapter *shuttle.EnvoyAlsServer = &shuttle.EnvoyAlsServer{}
@@ -196,48 +476,250 @@ func StartShuttleServices(client *storage.Storage, kafkaAddrs []string, port int
 	for {
 		drains.PrintMetrics()
 		logShuttle.PrintMetrics()
+		logProducer.PrintMetrics()
 		logShuttle.Refresh()
 		<-t.C
 	}
 }
 
-func CreateLogEvent(kafkaProducer events.LogProducer) func(martini.Params, events.LogSpec, binding.Errors, render.Render) {
-	return func(params martini.Params, opts events.LogSpec, berr binding.Errors, r render.Render) {
-		if berr != nil {
+// failedMessageSource is what keeps the recent undecodable messages, e.g., the
+// shuttle.
+type failedMessageSource interface {
+	FailedMessages(limit int) []shuttle.FailedMessage
+}
+
+func ListFailedMessages(logShuttle failedMessageSource) func(*http.Request, render.Render) {
+	return func(req *http.Request, r render.Render) {
+		limit, err := strconv.Atoi(req.URL.Query().Get("limit"))
+		if err != nil || limit < 1 {
+			limit = 20
+		}
+		r.JSON(http.StatusOK, logShuttle.FailedMessages(limit))
+	}
+}
+
+type logEventResult struct {
+	Index  int    `json:"index"`
+	Status int    `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// The largest batch of log events we'll accept in one request.
+const maxLogEventsBodySize = 1024 * 1024 * 10
+
+// How long to wait for kafka to acknowledge log events when ?wait=true.
+const defaultLogEventsWait = time.Second * 10
+
+// ParseLogEvents decodes a single log spec, a json array of log specs or
+// newline delimited json (one log spec per line), it returns whether the
+// body was a batch (array or more than one line).
+func ParseLogEvents(body []byte) ([]events.LogSpec, bool, error) {
+	var specs = make([]events.LogSpec, 0)
+	body = bytes.TrimSpace(body)
+	if bytes.HasPrefix(body, []byte("[")) {
+		if err := json.Unmarshal(body, &specs); err != nil {
+			return nil, true, err
+		}
+		return specs, true, nil
+	}
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	for {
+		var spec events.LogSpec
+		if err := decoder.Decode(&spec); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, true, err
+		}
+		specs = append(specs, spec)
+	}
+	return specs, len(specs) != 1, nil
+}
+
+// validateLogEvent checks a log event can be routed. A single event (rather
+// than a batch) is held to what /log-events accepted before batches were
+// supported, its time defaults to now and only the topic is required.
+func validateLogEvent(spec *events.LogSpec, batch bool) error {
+	if batch {
+		return spec.Validate()
+	}
+	if spec.Time.IsZero() {
+		spec.Time = time.Now()
+	}
+	if spec.Topic == "" {
+		return errors.New("a topic is required")
+	}
+	return nil
+}
+
+// logEventProducer is what publishes log events, e.g., the kafka producer.
+type logEventProducer interface {
+	AddLogs(messages []events.LogSpec, wait time.Duration) []error
+}
+
+// CreateLogEvents accepts one log spec, a json array or ndjson stream of log
+// specs and publishes them to kafka. If the wait query parameter is "true" or
+// a duration it waits for kafka to acknowledge delivery before responding.
+func CreateLogEvents(kafkaProducer logEventProducer) func(http.ResponseWriter, *http.Request, render.Render) {
+	return func(res http.ResponseWriter, req *http.Request, r render.Render) {
+		var wait time.Duration = 0
+		if w := req.URL.Query().Get("wait"); w == "true" {
+			wait = defaultLogEventsWait
+		} else if w != "" && w != "false" {
+			d, err := time.ParseDuration(w)
+			if err != nil || d < 0 {
+				ReportInvalidRequest(r)
+				return
+			}
+			wait = d
+		}
+		body, err := ioutil.ReadAll(http.MaxBytesReader(res, req.Body, maxLogEventsBodySize))
+		if err != nil {
+			ReportInvalidRequest(r)
+			return
+		}
+		specs, batch, err := ParseLogEvents(body)
+		if err != nil || len(specs) == 0 {
+			ReportInvalidRequest(r)
+			return
+		}
+
+		var results = make([]logEventResult, len(specs))
+		var valid = make([]events.LogSpec, 0, len(specs))
+		var indexes = make([]int, 0, len(specs))
+		for i := range specs {
+			results[i] = logEventResult{Index: i, Status: http.StatusCreated}
+			if err := validateLogEvent(&specs[i], batch); err != nil {
+				results[i].Status = http.StatusUnprocessableEntity
+				results[i].Error = err.Error()
+				continue
+			}
+			valid = append(valid, specs[i])
+			indexes = append(indexes, i)
+		}
+		var failed = len(specs) - len(valid)
+		for i, err := range kafkaProducer.AddLogs(valid, wait) {
+			if err != nil {
+				log.Printf("error: unable to add log event: %s\n", err)
+				results[indexes[i]].Status = http.StatusServiceUnavailable
+				results[indexes[i]].Error = err.Error()
+				failed++
+			}
+		}
+
+		if !batch {
+			if results[0].Status == http.StatusUnprocessableEntity {
+				ReportInvalidRequest(r)
+			} else if results[0].Error != "" {
+				ReportError(r, errors.New(results[0].Error))
+			} else {
+				r.JSON(http.StatusCreated, specs[0])
+			}
+			return
+		}
+		if failed > 0 {
+			r.JSON(http.StatusMultiStatus, results)
+		} else {
+			r.JSON(http.StatusCreated, results)
+		}
+	}
+}
+
+// The largest logplex body we'll accept, the http drain flushes at 64 lines
+// so this is generous for logshuttles forwarding to one another.
+const maxLogplexBodySize = 1024 * 1024 * 5
+
+// CreateLogplexEvents accepts application/logplex-1 octet framed syslog lines
+// (such as those produced by an http drain) and publishes them to the app's
+// space topic. The app-space is taken from the "app" query parameter or the
+// hostname of each syslog line.
+func CreateLogplexEvents(kafkaProducer events.LogProducer) func(http.ResponseWriter, *http.Request, render.Render) {
+	return func(res http.ResponseWriter, req *http.Request, r render.Render) {
+		if !strings.HasPrefix(req.Header.Get("Content-Type"), "application/logplex-1") {
 			ReportInvalidRequest(r)
 			return
 		}
-		err := kafkaProducer.AddLog(opts)
+		body, err := ioutil.ReadAll(http.MaxBytesReader(res, req.Body, maxLogplexBodySize))
 		if err != nil {
-			ReportError(r, err)
+			ReportInvalidRequest(r)
+			return
+		}
+		lines, err := syslog.ParseFrames(body)
+		if err != nil {
+			log.Printf("[logplex] Unable to parse frames: %s\n", err)
+			ReportInvalidRequest(r)
+			return
+		}
+		if count := req.Header.Get("Logplex-Msg-Count"); count != "" && count != strconv.Itoa(len(lines)) {
+			log.Printf("[logplex] Expected %s messages but received %d\n", count, len(lines))
+			ReportInvalidRequest(r)
 			return
 		}
-		r.JSON(http.StatusCreated, opts)
+		var specs = make([]events.LogSpec, 0, len(lines))
+		for _, line := range lines {
+			packet, err := syslog.ParseRFC5424(line)
+			if err != nil {
+				log.Printf("[logplex] Unable to parse syslog line: %s\n", err)
+				ReportInvalidRequest(r)
+				return
+			}
+			var msg events.LogSpec
+			if shuttle.ParseLogplexPacket(packet, req.URL.Query().Get("app"), &msg) {
+				ReportInvalidRequest(r)
+				return
+			}
+			specs = append(specs, msg)
+		}
+		for _, err := range kafkaProducer.AddLogs(specs, 0) {
+			if err != nil {
+				ReportError(r, err)
+				return
+			}
+		}
+		res.WriteHeader(http.StatusNoContent)
 	}
 }
 
-func StartHttpShuttleServices(client *storage.Storage, producer events.LogProducer, port int) {
+func StartHttpShuttleServices(client *storage.Storage, producer events.LogProducer, logShuttle *shuttle.Shuttle, port int) {
 	log.Println("[info] Starting logshuttle...")
 	m := martini.Classic()
 	m.Use(func(res http.ResponseWriter, req *http.Request) {
-		if req.Header.Get("Authorization") != os.Getenv("AUTH_KEY") && req.URL.Path != "/octhc" && !strings.Contains(req.URL.Path, "/debug") && req.URL.Path != "/metrics" {
+		if !IsAuthorized(req) && req.URL.Path != "/octhc" && !strings.Contains(req.URL.Path, "/debug") && req.URL.Path != "/metrics" {
 			res.WriteHeader(http.StatusUnauthorized)
 		}
 	})
 	m.Use(render.Renderer())
-	m.Get("/apps/:key/log-drains", ListLogDrains(client, false))
-	m.Post("/apps/:key/log-drains", binding.Json(logDrainCreateRequest{}), CreateLogDrain(client, false))
-	m.Delete("/apps/:key/log-drains/:id", DeleteLogDrain(client, false))
-	m.Get("/apps/:key/log-drains/:id", GetLogDrain(client, false))
+	m.Get("/apps/:key/log-drains", ListLogDrains(client, storage.RouteKindApp))
+	m.Post("/apps/:key/log-drains", binding.Json(logDrainCreateRequest{}), CreateLogDrain(client, &producer, storage.RouteKindApp))
+	m.Delete("/apps/:key/log-drains/:id", DeleteLogDrain(client, &producer, storage.RouteKindApp))
+	m.Patch("/apps/:key/log-drains/:id", binding.Json(logDrainUpdateRequest{}), UpdateLogDrain(client, &producer, storage.RouteKindApp))
+	m.Get("/apps/:key/log-drains/history", ListLogDrainHistory(client, storage.RouteKindApp))
+	m.Get("/apps/:key/log-drains/:id", GetLogDrain(client, storage.RouteKindApp))
+
+	m.Get("/apps/:key/redactions", ListRedactionRules(client))
+	m.Post("/apps/:key/redactions", binding.Json(redactionCreateRequest{}), CreateRedactionRule(client))
+	m.Delete("/apps/:key/redactions/:id", DeleteRedactionRule(client))
+
+	m.Get("/sites/:key/log-drains", ListLogDrains(client, storage.RouteKindSite))
+	m.Post("/sites/:key/log-drains", binding.Json(logDrainCreateRequest{}), CreateLogDrain(client, &producer, storage.RouteKindSite))
+	m.Delete("/sites/:key/log-drains/:id", DeleteLogDrain(client, &producer, storage.RouteKindSite))
+	m.Patch("/sites/:key/log-drains/:id", binding.Json(logDrainUpdateRequest{}), UpdateLogDrain(client, &producer, storage.RouteKindSite))
+	m.Get("/sites/:key/log-drains/history", ListLogDrainHistory(client, storage.RouteKindSite))
+	m.Get("/sites/:key/log-drains/:id", GetLogDrain(client, storage.RouteKindSite))
 
-	m.Get("/sites/:key/log-drains", ListLogDrains(client, true))
-	m.Post("/sites/:key/log-drains", binding.Json(logDrainCreateRequest{}), CreateLogDrain(client, true))
-	m.Delete("/sites/:key/log-drains/:id", DeleteLogDrain(client, true))
-	m.Get("/sites/:key/log-drains/:id", GetLogDrain(client, true))
+	m.Get("/spaces/:key/log-drains", ListLogDrains(client, storage.RouteKindSpace))
+	m.Post("/spaces/:key/log-drains", binding.Json(logDrainCreateRequest{}), CreateLogDrain(client, &producer, storage.RouteKindSpace))
+	m.Delete("/spaces/:key/log-drains/:id", DeleteLogDrain(client, &producer, storage.RouteKindSpace))
+	m.Patch("/spaces/:key/log-drains/:id", binding.Json(logDrainUpdateRequest{}), UpdateLogDrain(client, &producer, storage.RouteKindSpace))
+	m.Get("/spaces/:key/log-drains/history", ListLogDrainHistory(client, storage.RouteKindSpace))
+	m.Get("/spaces/:key/log-drains/:id", GetLogDrain(client, storage.RouteKindSpace))
 
 	m.Get("/octhc", HealthCheck(client))
+	// Private end point to sample recent messages that could not be decoded.
+	m.Get("/failed-messages", ListFailedMessages(logShuttle))
 	// Private end point to create new events within the log stream that are controller-api specifc.
-	m.Post("/log-events", binding.Json(events.LogSpec{}), CreateLogEvent(producer))
+	m.Post("/log-events", CreateLogEvents(&producer))
+	// Logplex compatible end point so heroku style drains (or other logshuttles) can forward to us.
+	m.Post("/logs", CreateLogplexEvents(producer))
 
 	if os.Getenv("PROFILE") != "" {
 		m.Group("/debug/pprof", func(r martini.Router) {
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/akkeris/logshuttle/events"
+	"github.com/akkeris/logshuttle/shuttle"
+	"github.com/go-martini/martini"
+	"github.com/martini-contrib/render"
+	. "github.com/smartystreets/goconvey/convey"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// failedMessages returns the first limit messages it has.
+type failedMessages []shuttle.FailedMessage
+
+func (f failedMessages) FailedMessages(limit int) []shuttle.FailedMessage {
+	if limit > len(f) {
+		limit = len(f)
+	}
+	return f[0:limit]
+}
+
+func requestFailedMessages(source failedMessageSource, url string) (*httptest.ResponseRecorder, []map[string]interface{}) {
+	m := martini.New()
+	router := martini.NewRouter()
+	m.Use(render.Renderer())
+	m.Action(router.Handle)
+	router.Get("/failed-messages", ListFailedMessages(source))
+	res := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", url, nil)
+	m.ServeHTTP(res, req)
+	var body []map[string]interface{}
+	json.Unmarshal(res.Body.Bytes(), &body)
+	return res, body
+}
+
+func TestListFailedMessages(t *testing.T) {
+	var failed = make(failedMessages, 0)
+	for i := 0; i < 30; i++ {
+		failed = append(failed, shuttle.FailedMessage{Topic: "alamoweblogs", Partition: 3, Offset: int64(1000 - i), Error: "unable to parse log message", Value: "hostname=...", Received: time.Date(2016, 7, 18, 14, 55, 38, 0, time.UTC)})
+	}
+	Convey("Ensure failed messages are listed with where they came from and why they failed.", t, func() {
+		res, body := requestFailedMessages(failed, "/failed-messages?limit=2")
+		So(res.Code, ShouldEqual, http.StatusOK)
+		So(len(body), ShouldEqual, 2)
+		So(body[0], ShouldResemble, map[string]interface{}{
+			"topic":     "alamoweblogs",
+			"partition": float64(3),
+			"offset":    float64(1000),
+			"error":     "unable to parse log message",
+			"value":     "hostname=...",
+			"received":  "2016-07-18T14:55:38Z",
+		})
+		So(body[1]["offset"], ShouldEqual, float64(999))
+	})
+	Convey("Ensure failed messages default to a limit of 20.", t, func() {
+		for _, url := range []string{"/failed-messages", "/failed-messages?limit=0", "/failed-messages?limit=abc"} {
+			_, body := requestFailedMessages(failed, url)
+			So(len(body), ShouldEqual, 20)
+		}
+	})
+	Convey("Ensure no failed messages is an empty list.", t, func() {
+		res, _ := requestFailedMessages(failedMessages{}, "/failed-messages")
+		So(res.Body.String(), ShouldEqual, "[]")
+	})
+}
+
+// logEvents records what it's asked to publish, events for the "unavailable"
+// topic fail.
+type logEvents struct {
+	added []events.LogSpec
+	wait  time.Duration
+}
+
+func (l *logEvents) AddLogs(messages []events.LogSpec, wait time.Duration) []error {
+	var errs = make([]error, len(messages))
+	l.wait = wait
+	for i, message := range messages {
+		if message.Topic == "unavailable" {
+			errs[i] = errors.New("kafka is unavailable")
+			continue
+		}
+		l.added = append(l.added, message)
+	}
+	return errs
+}
+
+func requestLogEvents(producer logEventProducer, url string, body string) *httptest.ResponseRecorder {
+	m := martini.New()
+	router := martini.NewRouter()
+	m.Use(render.Renderer())
+	m.Action(router.Handle)
+	router.Post("/log-events", CreateLogEvents(producer))
+	res := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", url, strings.NewReader(body))
+	m.ServeHTTP(res, req)
+	return res
+}
+
+const testLogEvent = `{"log":"%s","time":"2020-01-01T00:00:00Z","topic":"space","kubernetes":{"container_name":"app"}}`
+
+func logEvent(message string) string {
+	return strings.Replace(testLogEvent, "%s", message, 1)
+}
+
+func TestParseLogEvents(t *testing.T) {
+	Convey("Ensure single events, json arrays and ndjson are parsed.", t, func() {
+		var tests = []struct {
+			body  string
+			logs  []string
+			batch bool
+		}{
+			{logEvent("one"), []string{"one"}, false},
+			{"\n  " + logEvent("one") + "\n", []string{"one"}, false},
+			{"[" + logEvent("one") + "]", []string{"one"}, true},
+			{"[" + logEvent("one") + "," + logEvent("two") + "]", []string{"one", "two"}, true},
+			{logEvent("one") + "\n" + logEvent("two") + "\n" + logEvent("three"), []string{"one", "two", "three"}, true},
+			{"[]", []string{}, true},
+			{"", []string{}, true},
+		}
+		for _, test := range tests {
+			specs, batch, err := ParseLogEvents([]byte(test.body))
+			So(err, ShouldBeNil)
+			So(batch, ShouldEqual, test.batch)
+			var logs = make([]string, 0)
+			for _, spec := range specs {
+				logs = append(logs, spec.Log)
+				So(spec.Topic, ShouldEqual, "space")
+			}
+			So(logs, ShouldResemble, test.logs)
+		}
+	})
+	Convey("Ensure malformed bodies are rejected.", t, func() {
+		for _, body := range []string{"not json", "[" + logEvent("one") + ",", logEvent("one") + "\n{", `{"time":"yesterday"}`} {
+			_, _, err := ParseLogEvents([]byte(body))
+			So(err, ShouldNotBeNil)
+		}
+	})
+}
+
+func TestCreateLogEvents(t *testing.T) {
+	Convey("Ensure a single event is published and echoed back.", t, func() {
+		producer := &logEvents{}
+		res := requestLogEvents(producer, "/log-events", logEvent("hello"))
+		So(res.Code, ShouldEqual, http.StatusCreated)
+		So(len(producer.added), ShouldEqual, 1)
+		So(producer.added[0].Log, ShouldEqual, "hello")
+		So(producer.wait, ShouldEqual, 0)
+		var body events.LogSpec
+		So(json.Unmarshal(res.Body.Bytes(), &body), ShouldBeNil)
+		So(body.Log, ShouldEqual, "hello")
+	})
+	Convey("Ensure a single event without a time or container is accepted, as it was before batches.", t, func() {
+		producer := &logEvents{}
+		before := time.Now()
+		res := requestLogEvents(producer, "/log-events", `{"log":"no time","topic":"space"}`)
+		So(res.Code, ShouldEqual, http.StatusCreated)
+		So(len(producer.added), ShouldEqual, 1)
+		So(producer.added[0].Time, ShouldHappenOnOrAfter, before)
+		So(producer.added[0].Kubernetes.ContainerName, ShouldEqual, "")
+		var body events.LogSpec
+		So(json.Unmarshal(res.Body.Bytes(), &body), ShouldBeNil)
+		So(body.Time.IsZero(), ShouldBeFalse)
+	})
+	Convey("Ensure a single event without a topic is rejected.", t, func() {
+		producer := &logEvents{}
+		res := requestLogEvents(producer, "/log-events", `{"log":"no topic","kubernetes":{"container_name":"app"}}`)
+		So(res.Body.String(), ShouldEqual, `"Malformed Request"`)
+		So(len(producer.added), ShouldEqual, 0)
+	})
+	Convey("Ensure events in a batch need a time and container.", t, func() {
+		producer := &logEvents{}
+		res := requestLogEvents(producer, "/log-events", `[{"log":"no time","topic":"space","kubernetes":{"container_name":"app"}},{"log":"no container","topic":"space","time":"2020-01-01T00:00:00Z"}]`)
+		So(res.Code, ShouldEqual, http.StatusMultiStatus)
+		So(len(producer.added), ShouldEqual, 0)
+		var results []logEventResult
+		So(json.Unmarshal(res.Body.Bytes(), &results), ShouldBeNil)
+		So(results, ShouldResemble, []logEventResult{
+			{Index: 0, Status: http.StatusUnprocessableEntity, Error: "a time is required"},
+			{Index: 1, Status: http.StatusUnprocessableEntity, Error: "a kubernetes container_name is required"},
+		})
+	})
+	Convey("Ensure a json array or ndjson of events is published with a result for each.", t, func() {
+		for _, body := range []string{"[" + logEvent("one") + "," + logEvent("two") + "]", logEvent("one") + "\n" + logEvent("two") + "\n"} {
+			producer := &logEvents{}
+			res := requestLogEvents(producer, "/log-events", body)
+			So(res.Code, ShouldEqual, http.StatusCreated)
+			So(len(producer.added), ShouldEqual, 2)
+			So(producer.added[1].Log, ShouldEqual, "two")
+			var results []logEventResult
+			So(json.Unmarshal(res.Body.Bytes(), &results), ShouldBeNil)
+			So(results, ShouldResemble, []logEventResult{{Index: 0, Status: http.StatusCreated}, {Index: 1, Status: http.StatusCreated}})
+		}
+	})
+	Convey("Ensure invalid or undeliverable events in a batch don't stop the others.", t, func() {
+		producer := &logEvents{}
+		var invalid = `{"log":"no topic","time":"2020-01-01T00:00:00Z","kubernetes":{"container_name":"app"}}`
+		var unavailable = strings.Replace(logEvent("unavailable"), `"topic":"space"`, `"topic":"unavailable"`, 1)
+		res := requestLogEvents(producer, "/log-events", "["+logEvent("one")+","+invalid+","+unavailable+","+logEvent("four")+"]")
+		So(res.Code, ShouldEqual, http.StatusMultiStatus)
+		So(len(producer.added), ShouldEqual, 2)
+		So(producer.added[0].Log, ShouldEqual, "one")
+		So(producer.added[1].Log, ShouldEqual, "four")
+		var results []logEventResult
+		So(json.Unmarshal(res.Body.Bytes(), &results), ShouldBeNil)
+		So(results, ShouldResemble, []logEventResult{
+			{Index: 0, Status: http.StatusCreated},
+			{Index: 1, Status: http.StatusUnprocessableEntity, Error: "a topic is required"},
+			{Index: 2, Status: http.StatusServiceUnavailable, Error: "kafka is unavailable"},
+			{Index: 3, Status: http.StatusCreated},
+		})
+	})
+	Convey("Ensure empty and malformed bodies are rejected without publishing.", t, func() {
+		for _, body := range []string{"", "  \n", "[]", "not json", "[" + logEvent("one")} {
+			producer := &logEvents{}
+			res := requestLogEvents(producer, "/log-events", body)
+			So(res.Body.String(), ShouldEqual, `"Malformed Request"`)
+			So(len(producer.added), ShouldEqual, 0)
+		}
+	})
+	Convey("Ensure ?wait waits for kafka to acknowledge the events.", t, func() {
+		var tests = []struct {
+			url  string
+			wait time.Duration
+		}{
+			{"/log-events?wait=true", defaultLogEventsWait},
+			{"/log-events?wait=false", 0},
+			{"/log-events?wait=250ms", time.Millisecond * 250},
+		}
+		for _, test := range tests {
+			producer := &logEvents{}
+			res := requestLogEvents(producer, test.url, logEvent("hello"))
+			So(res.Code, ShouldEqual, http.StatusCreated)
+			So(producer.wait, ShouldEqual, test.wait)
+		}
+		for _, url := range []string{"/log-events?wait=soon", "/log-events?wait=-1s"} {
+			producer := &logEvents{}
+			res := requestLogEvents(producer, url, logEvent("hello"))
+			So(res.Body.String(), ShouldEqual, `"Malformed Request"`)
+			So(len(producer.added), ShouldEqual, 0)
+		}
+	})
+	Convey("Ensure a single event kafka doesn't accept is an error.", t, func() {
+		producer := &logEvents{}
+		res := requestLogEvents(producer, "/log-events", strings.Replace(logEvent("hello"), `"topic":"space"`, `"topic":"unavailable"`, 1))
+		So(res.Code, ShouldEqual, http.StatusInternalServerError)
+	})
+}
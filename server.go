@@ -18,10 +18,27 @@ func ReportInvalidRequest(r render.Render) {
 }
 
 func ReportError(r render.Render, err error) {
+	if err == storage.ErrReadOnly {
+		r.JSON(http.StatusForbidden, map[string]interface{}{"message": err.Error()})
+		return
+	}
 	log.Printf("error: %s", err)
 	r.JSON(http.StatusInternalServerError, map[string]interface{}{"message": "Internal Server Error"})
 }
 
+// IsAuthorized checks the Authorization header against the AUTH_KEY, logplex
+// style drains can only pass credentials in the url so the password of basic
+// auth is also accepted.
+func IsAuthorized(req *http.Request) bool {
+	if req.Header.Get("Authorization") == os.Getenv("AUTH_KEY") {
+		return true
+	}
+	if _, password, ok := req.BasicAuth(); ok && os.Getenv("AUTH_KEY") != "" && password == os.Getenv("AUTH_KEY") {
+		return true
+	}
+	return false
+}
+
 func HealthCheck(client *storage.Storage) func(http.ResponseWriter, *http.Request, martini.Params) {
 	return func(res http.ResponseWriter, req *http.Request, params martini.Params) {
 		err := (*client).HealthCheck()
@@ -36,26 +53,32 @@ func HealthCheck(client *storage.Storage) func(http.ResponseWriter, *http.Reques
 	}
 }
 
-func main() {
-	var kafkaGroup = "logshuttle"
-	// Get kafka group for testing.
-	if os.Getenv("TEST_MODE") != "" {
-		log.Printf("Using kafka group logshuttle-testing for testing purposes...\n")
-		kafkaGroup = "logshuttletest"
+// Migrate upgrades the storage schema without starting the shuttle (logshuttle
+// migrate), storage is also migrated on start up so this is optional.
+func Migrate() {
+	if os.Getenv("REDIS_URL") != "" {
+		var redis storage.RedisStorage
+		if err := redis.Init(os.Getenv("REDIS_URL")); err != nil {
+			log.Fatalf("Fatal: Cannot migrate redis: %v\n", err)
+		}
+		redis.Close()
+	} else if os.Getenv("POSTGRES_URL") != "" {
+		if err := storage.MigratePostgres(os.Getenv("POSTGRES_URL")); err != nil {
+			log.Fatalf("Fatal: Cannot migrate postgres: %v\n", err)
+		}
 	} else {
-		// Purposely wait a random amount of time to allow
-		// kafka to more easily balance more than one logshuttle, if the
-		// connection between kafka is too close, partition assignment
-		// can sometimes take a very long time. Seems odd, but helps.
-		time.Sleep(time.Duration(rand.Intn(30)) * time.Second)
+		log.Fatalf("Cannot find REDIS_URL or POSTGRES_URL. Abandoning ship.\n")
 	}
-	
+	log.Printf("Storage is up to date.\n")
+}
 
-	// Connect to storage instance
+// ConnectStorage connects to the configured storage, drain urls are encrypted
+// if DRAIN_ENCRYPTION_KEYS (or DRAIN_ENCRYPTION_KEYS_FILE) is set.
+func ConnectStorage() storage.Storage {
 	var s storage.Storage
 	if os.Getenv("REDIS_URL") != "" {
 		var redis storage.RedisStorage
-		if err := redis.Init(strings.Replace(os.Getenv("REDIS_URL"), "redis://", "", 1)); err != nil {
+		if err := redis.Init(os.Getenv("REDIS_URL")); err != nil {
 			log.Fatalf("Fatal: Cannot connect to redis: %v\n", err)
 		}
 		s = &redis
@@ -65,9 +88,72 @@ func main() {
 			log.Fatalf("Fatal: Cannot connect to postgres: %v\n", err)
 		}
 		s = &postgres
+	} else if os.Getenv("ROUTES_FILE") != "" {
+		var file storage.FileStorage
+		if err := file.Init(os.Getenv("ROUTES_FILE")); err != nil {
+			log.Fatalf("Fatal: Cannot read routes file: %v\n", err)
+		}
+		s = &file
+	} else if os.Getenv("MEMORY_STORAGE") == "true" {
+		var memory storage.MemoryStorage
+		if err := memory.Init(os.Getenv("MEMORY_STORAGE_SNAPSHOT")); err != nil {
+			log.Fatalf("Fatal: Cannot read memory storage snapshot: %v\n", err)
+		}
+		s = &memory
 	} else {
-		log.Fatalf("Cannot find REDIS_URL or POSTGRES_URL. Abandoning ship.\n")
+		log.Fatalf("Cannot find REDIS_URL, POSTGRES_URL, ROUTES_FILE or MEMORY_STORAGE. Abandoning ship.\n")
 	}
+	keys, err := storage.LoadDrainKeys()
+	if err != nil {
+		log.Fatalf("Fatal: Cannot load drain encryption keys: %v\n", err)
+	}
+	if keys != nil {
+		s = storage.NewEncryptedStorage(s, keys)
+	}
+	return s
+}
+
+// ReencryptDrains encrypts drain urls with the first (primary) drain encryption
+// key (logshuttle reencrypt-drains), run it after adding a key or enabling
+// encryption, once it's done older keys can be removed.
+func ReencryptDrains() {
+	s, ok := ConnectStorage().(*storage.EncryptedStorage)
+	if !ok {
+		log.Fatalf("Cannot find DRAIN_ENCRYPTION_KEYS or DRAIN_ENCRYPTION_KEYS_FILE. Abandoning ship.\n")
+	}
+	defer s.Close()
+	count, err := s.ReencryptRoutes()
+	if err != nil {
+		log.Fatalf("Fatal: Cannot reencrypt drains (%d were reencrypted): %v\n", count, err)
+	}
+	log.Printf("Reencrypted %d drains.\n", count)
+}
+
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		Migrate()
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "reencrypt-drains" {
+		ReencryptDrains()
+		return
+	}
+	var kafkaGroup = "logshuttle"
+	// Get kafka group for testing.
+	if os.Getenv("TEST_MODE") != "" {
+		log.Printf("Using kafka group logshuttle-testing for testing purposes...\n")
+		kafkaGroup = "logshuttletest"
+	} else {
+		// Purposely wait a random amount of time to allow
+		// kafka to more easily balance more than one logshuttle, if the
+		// connection between kafka is too close, partition assignment
+		// can sometimes take a very long time. Seems odd, but helps.
+		time.Sleep(time.Duration(rand.Intn(30)) * time.Second)
+	}
+	
+
+	// Connect to storage instance
+	var s storage.Storage = ConnectStorage()
 
 	kafkaAddrs := strings.Split(os.Getenv("KAFKA_HOSTS"), ",")
 	port, err := strconv.Atoi(os.Getenv("PORT"))
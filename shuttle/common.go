@@ -3,8 +3,8 @@ package shuttle
 import (
 	"encoding/json"
 	"github.com/akkeris/logshuttle/events"
+	"github.com/akkeris/logshuttle/syslog"
 	"net/url"
-	"regexp"
 	"strings"
 	"time"
 	"strconv"
@@ -143,6 +143,7 @@ type buildLogSpec struct {
 	Build    int    `json:"build"`
 	Job      string `json:"job"`
 	Message  string `json:"message"`
+	Time     string `json:"time,omitempty"`
 }
 
 func StringToIntOrZero(target *string) int {
@@ -155,23 +156,42 @@ func StringToIntOrZero(target *string) int {
 	}
 	return val
 }
-func ParseIstioFromEnvoyWebLogMessage(data []byte, msg *events.LogSpec) bool {
+func ParseIstioFromEnvoyWebLogMessage(data []byte, msg *events.LogSpec) error {
 	//https://github.com/envoyproxy/go-control-plane/blob/master/envoy/data/accesslog/v2/accesslog.pb.go#L246
 	//https://github.com/envoyproxy/go-control-plane/blob/master/envoy/data/accesslog/v2/accesslog.pb.go#L857
 	//https://github.com/envoyproxy/go-control-plane/blob/master/envoy/data/accesslog/v2/accesslog.pb.go#L372
 
 	var istioMsg istio16LogSpec
 	if err := json.Unmarshal(data, &istioMsg); err != nil {
-		return true
+		return fmt.Errorf("istio: %s", err)
 	}
-	if istioMsg.CommonProperties == nil ||
-		istioMsg.CommonProperties.UpstreamCluster == "" || 
-		istioMsg.Response == nil ||
-		istioMsg.Request == nil ||
-		istioMsg.Response.ResponseCode == nil || 
-		istioMsg.CommonProperties.TimeToLastUpstreamTxByte == nil || 
-		istioMsg.CommonProperties.TimeToLastRxByte == nil {
-		return true
+	if istioMsg.CommonProperties == nil {
+		return errors.New("istio: missing common_properties")
+	}
+	if istioMsg.Request == nil {
+		return errors.New("istio: missing request")
+	}
+	if istioMsg.Response == nil || istioMsg.Response.ResponseCode == nil {
+		return errors.New("istio: missing response.response_code")
+	}
+	var durations = []struct {
+		field string
+		value *Duration
+	}{
+		{"time_to_last_rx_byte", istioMsg.CommonProperties.TimeToLastRxByte},
+		{"time_to_last_upstream_tx_byte", istioMsg.CommonProperties.TimeToLastUpstreamTxByte},
+		{"time_to_last_upstream_rx_byte", istioMsg.CommonProperties.TimeToLastUpstreamRxByte},
+		{"time_to_last_downstream_tx_byte", istioMsg.CommonProperties.TimeToLastDownstreamTxByte},
+	}
+	for _, duration := range durations {
+		if duration.value == nil {
+			return fmt.Errorf("istio: missing common_properties.%s", duration.field)
+		}
+	}
+	// e.g., outbound|80||app.space.svc.cluster.local
+	c := strings.Split(istioMsg.CommonProperties.UpstreamCluster, "|")
+	if len(c) < 4 || len(strings.Split(c[3], ".")) < 2 {
+		return fmt.Errorf("istio: common_properties.upstream_cluster %q has no app and space", istioMsg.CommonProperties.UpstreamCluster)
 	}
 
 	var code int = 0
@@ -192,8 +212,6 @@ func ParseIstioFromEnvoyWebLogMessage(data []byte, msg *events.LogSpec) bool {
 		tlsSNIHostname = "https://" + (*istioMsg.CommonProperties.TLSProperties.TLSSNIHostname) + istioMsg.Request.OriginalPath
 	}
 
-
-	c := strings.Split(istioMsg.CommonProperties.UpstreamCluster, "|")
 	d := strings.Split(c[3], ".")
 	app := d[0]
 	space := d[1]
@@ -214,7 +232,10 @@ func ParseIstioFromEnvoyWebLogMessage(data []byte, msg *events.LogSpec) bool {
 		"dyno=" + app + "-" + space
 
 	msg.Stream = ""
-	msg.Time = time.Now()
+	msg.Time = time.Time{}
+	if istioMsg.CommonProperties.StartTime != nil {
+		msg.Time = *istioMsg.CommonProperties.StartTime
+	}
 	msg.Space = space
 	msg.Site = "" // TODO
 	msg.SitePath = "" // TODO
@@ -229,13 +250,13 @@ func ParseIstioFromEnvoyWebLogMessage(data []byte, msg *events.LogSpec) bool {
 	msg.Topic = space
 	msg.Tag = ""
 
-	return false
+	return nil
 }
 
-func ParseIstioWebLogMessage(data []byte, msg *events.LogSpec) bool {
+func ParseIstioWebLogMessage(data []byte, msg *events.LogSpec) error {
 	var istioMsg istioLogSpec
 	if err := json.Unmarshal(data, &istioMsg); err != nil {
-		return true
+		return fmt.Errorf("istio: %s", err)
 	}
 
 	msg.Log = "bytes=" + strconv.Itoa(istioMsg.Bytes) + " " +
@@ -250,7 +271,7 @@ func ParseIstioWebLogMessage(data []byte, msg *events.LogSpec) bool {
 		"dyno=" + istioMsg.Dyno
 
 	msg.Stream = ""
-	msg.Time = time.Now()
+	msg.Time = istioMsg.Time
 	msg.Space = istioMsg.Space
 	msg.Site = "" // TODO
 	msg.SitePath = "" // TODO
@@ -265,16 +286,14 @@ func ParseIstioWebLogMessage(data []byte, msg *events.LogSpec) bool {
 	msg.Topic = istioMsg.Space
 	msg.Tag = ""
 
-	return false
+	return nil
 }
 
 
-var rex *regexp.Regexp
-
-func ParseBuildLogMessage(data []byte, msg *events.LogSpec) bool {
+func ParseBuildLogMessage(data []byte, msg *events.LogSpec) error {
 	var bmsg buildLogSpec
 	if err := json.Unmarshal(data, &bmsg); err != nil {
-		return true
+		return fmt.Errorf("build: %s", err)
 	} else {
 		var app = ""
 		var space = ""
@@ -288,14 +307,11 @@ func ParseBuildLogMessage(data []byte, msg *events.LogSpec) bool {
 		}
 
 		if app == "" || space == "" {
-			return true
-		}
-		if rex == nil {
-			rex = regexp.MustCompile("(Step \\d+/\\d+ : ARG [0-9A-Za-z_]+=).*")
+			return fmt.Errorf("build: metadata %q has no app and space", bmsg.Metadata)
 		}
 		msg.Log = bmsg.Message
 		msg.Stream = ""
-		msg.Time = time.Now()
+		msg.Time = ParseSourceTime(bmsg.Time)
 		msg.Space = space
 		msg.Kubernetes.NamespaceName = space
 		msg.Kubernetes.PodId = ""
@@ -306,58 +322,68 @@ func ParseBuildLogMessage(data []byte, msg *events.LogSpec) bool {
 		msg.Kubernetes.Host = ""
 		msg.Topic = space
 		msg.Tag = ""
-		return false
+		return nil
+	}
+}
+
+// ParseWebLog parses a logfmt F5/nginx web log line, the hostname field
+// (e.g., app-space.domain.com) determines the app and space. Unknown fields
+// are kept, timestamp becomes the log's time and source is reformatted as fwd.
+func ParseWebLog(data []byte) (events.LogSpec, error) {
+	pairs, err := ParseLogfmt(string(data))
+	if err != nil {
+		return events.LogSpec{}, err
 	}
+	return WebLogFromPairs(pairs)
 }
 
-func ParseWebLogMessage(data []byte, msg *events.LogSpec) bool {
+// WebLogFromPairs builds a router log from F5 style fields, other web log
+// formats are converted to these fields so they produce the same router line.
+func WebLogFromPairs(pairs []LogfmtPair) (events.LogSpec, error) {
+	var msg events.LogSpec
 	var app = ""
 	var space = ""
-	var reformattedMessage = ""
 	var site = ""
 	var site_path = ""
 	var path = ""
-	var message = string(data)
+	var timestamp time.Time
 
-	for _, block := range strings.Fields(message) {
-		var value = strings.SplitN(block, "=", 2)
-		if len(value) < 2 {
-			return true
-		} else {
-			if value[0] == "hostname" {
-				urls := strings.Split(value[1], ".")
-				app = urls[0]
-				var splitAppName = strings.SplitN(app, "-", 2)
-				app = splitAppName[0]
-				if len(splitAppName) == 1 {
-					space = "default"
-				} else {
-					space = splitAppName[1]
-				}
-			} else if value[0] == "source" {
-				unescaped, err := url.QueryUnescape(strings.TrimSpace(value[1]))
-				if err != nil {
-					reformattedMessage = reformattedMessage + "fwd=\"" + value[1] + "\" "
-				} else {
-					reformattedMessage = reformattedMessage + "fwd=\"" + unescaped + "\" "
-				}
-			} else if value[0] == "path" {
-				path = value[1]
-			} else if value[0] == "site_domain" {
-				site = value[1]
-			} else if value[0] == "site_path" {
-				site_path = value[1]
-			} else if value[0] != "timestamp" {
-				reformattedMessage = reformattedMessage + value[0] + "=" + value[1] + " "
+	var reformatted = make([]LogfmtPair, 0, len(pairs))
+	for _, pair := range pairs {
+		if pair.Key == "hostname" {
+			urls := strings.Split(pair.Value, ".")
+			var splitAppName = strings.SplitN(urls[0], "-", 2)
+			app = splitAppName[0]
+			if len(splitAppName) == 1 {
+				space = "default"
+			} else {
+				space = splitAppName[1]
+			}
+		} else if pair.Key == "source" {
+			unescaped, err := url.QueryUnescape(strings.TrimSpace(pair.Value))
+			if err != nil {
+				unescaped = pair.Value
 			}
+			// fwd is always quoted for compatibility with existing drains.
+			reformatted = append(reformatted, LogfmtPair{Key: "fwd=" + strconv.Quote(unescaped), Bare: true})
+		} else if pair.Key == "path" {
+			path = pair.Value
+		} else if pair.Key == "site_domain" {
+			site = pair.Value
+		} else if pair.Key == "site_path" {
+			site_path = pair.Value
+		} else if pair.Key == "timestamp" {
+			timestamp = ParseSourceTime(pair.Value)
+		} else {
+			reformatted = append(reformatted, pair)
 		}
 	}
 	if app == "" || space == "" {
-		return true
+		return msg, &LogfmtError{Key: "hostname", Offset: 0, Reason: "missing or invalid app-space"}
 	}
-	msg.Log = strings.TrimSpace(reformattedMessage)
+	msg.Log = FormatLogfmt(reformatted)
 	msg.Stream = ""
-	msg.Time = time.Now()
+	msg.Time = timestamp
 	msg.Space = space
 	msg.Site = site
 	msg.SitePath = site_path
@@ -371,36 +397,61 @@ func ParseWebLogMessage(data []byte, msg *events.LogSpec) bool {
 	msg.Kubernetes.Host = ""
 	msg.Topic = space
 	msg.Tag = ""
-	return false
+	return msg, nil
+}
+
+func ParseWebLogMessage(data []byte, msg *events.LogSpec) error {
+	parsed, err := ParseWebLog(data)
+	if err != nil {
+		return err
+	}
+	*msg = parsed
+	return nil
 }
 
-func KubernetesToHumanReadable(message string) string {
-	// early bail out.
-	if !strings.HasPrefix(message, "Phase: ") {
-		return message
-		// Phase: Creating -- Creating pod blog-1050769379-6ktnc
-	} else if strings.HasPrefix(message, "Phase: Creating -- ") {
-		return "Creating Dyno"
-		//Phase: Pending/ --
-	} else if strings.HasPrefix(message, "Phase: Pending/ --") {
-		return "Waiting on Dyno"
-		//Phase: Pending/waiting --  reason=ContainerCreating
-	} else if strings.HasPrefix(message, "Phase: Pending/waiting --") {
-		return "Waiting on Dyno"
-		// Phase: Running/waiting --  reason=CrashLoopBackOff message=Back-off 5m0s restarting failed container=useraccount pod=useraccount-3805495696-7lrj3_perf-stg(60fa2fa3-4d3a-11e7-82b9-02ef34ee5340)
-	} else if strings.HasPrefix(message, "Phase: Running/waiting --") {
-		return "at=error code=H10 desc=\"App crashed\""
-		//Phase: Running/running --  startedAt=2017-06-16T16:16:30
-	} else if strings.HasPrefix(message, "Phase: Running/running --") {
-		return "Checking Dyno Health"
-		//Stopping Dyno (Phase: Running/terminated --  reason=Error startedAt=2017-06-16T16:12:39Z finishedAt=2017-06-16T16:17:09Z containerID=docker://5d822d1bfc8ea75a3fc5a04c6d3ce319da62f0fde078646ab1fea760199a8f59 exitCode=137
-	} else if strings.HasPrefix(message, "Phase: Running/terminated --") {
-		re := regexp.MustCompile("exitCode=([1-9]+)")
-		return "Dyno exited (" + strings.Replace(re.FindString(message), "exitCode=", "exit code ", 1) + ")"
-		//Phase: Deleting -- pod blog-472348638-9tzlx in space default
-	} else if strings.HasPrefix(message, "Phase: Deleting -- pod") {
-		return "Deleting Dyno"
+// ParseLogplexPacket converts a syslog packet received from a logplex drain
+// (another logshuttle, heroku, etc) back into a log spec. The key is the
+// app-space the packet belongs to, if empty the packet's hostname is used.
+func ParseLogplexPacket(packet syslog.Packet, key string, msg *events.LogSpec) bool {
+	if key == "" {
+		key = packet.Hostname
+	}
+	var splitAppName = strings.SplitN(key, "-", 2)
+	if len(splitAppName) != 2 || splitAppName[0] == "" || splitAppName[1] == "" {
+		return true
+	}
+	var app = splitAppName[0]
+	var space = splitAppName[1]
+
+	msg.Log = packet.Message
+	msg.Stream = "stdout"
+	if packet.Severity <= syslog.SevErr {
+		msg.Stream = "stderr"
+	}
+	msg.Time = packet.Time
+	msg.Space = space
+	msg.Kubernetes.NamespaceName = space
+	msg.Kubernetes.PodId = ""
+	msg.Kubernetes.ContainerName = app
+	if strings.HasPrefix(packet.Tag, "akkeris/") {
+		msg.Kubernetes.PodName = packet.Tag
 	} else {
-		return message
+		// Tags are formatted as type.instance, rebuild a container and pod name
+		// that SendMessage will turn back into the same tag.
+		var proc = strings.SplitN(packet.Tag, ".", 2)
+		if proc[0] != "" && proc[0] != "web" {
+			msg.Kubernetes.ContainerName = app + "--" + proc[0]
+		}
+		if len(proc) == 2 {
+			msg.Kubernetes.PodName = app + "-" + proc[1]
+		} else {
+			msg.Kubernetes.PodName = app
+		}
 	}
+	msg.Kubernetes.Labels.Name = ""
+	msg.Kubernetes.Labels.PodTemplateHash = ""
+	msg.Kubernetes.Host = ""
+	msg.Topic = space
+	msg.Tag = ""
+	return false
 }
@@ -40,7 +40,8 @@ func (s *EnvoyAlsServer) StreamAccessLogs(stream v2.AccessLogService_StreamAcces
 		case *v2.StreamAccessLogsMessage_HttpLogs:
 			for _, entry := range entries.HttpLogs.LogEntry {
 				str, _ := s.marshaler.MarshalToString(entry)
-				if err := s.producer.AddRaw("istio-access-logs", str); err != nil {
+				// Key by upstream cluster (the app) so an app's access logs stay in order.
+				if err := s.producer.AddRaw(events.Topics().IstioWebLogs, entry.GetCommonProperties().GetUpstreamCluster(), str); err != nil {
 					log.Printf("Failed to send istio access logs to kafka: %s\n", err.Error())
 					return err
 				}
@@ -0,0 +1,95 @@
+package shuttle
+
+import (
+	"github.com/akkeris/logshuttle/events"
+	"github.com/akkeris/logshuttle/storage"
+	"github.com/akkeris/logshuttle/syslog"
+	"regexp"
+)
+
+// routeFilter is the compiled form of a route's filters.
+type routeFilter struct {
+	sources        map[string]bool
+	excludeSources map[string]bool
+	processTypes   map[string]bool
+	minSeverity    *syslog.Priority
+	include        *regexp.Regexp
+	exclude        *regexp.Regexp
+}
+
+func toSet(values []string) map[string]bool {
+	if len(values) == 0 {
+		return nil
+	}
+	var set = make(map[string]bool)
+	for _, v := range values {
+		set[v] = true
+	}
+	return set
+}
+
+// compileRouteFilter compiles a route's filters, nil (allow all) is returned
+// if the route has none.
+func compileRouteFilter(filters *storage.RouteFilters) (*routeFilter, error) {
+	if filters == nil {
+		return nil, nil
+	}
+	if err := filters.Validate(); err != nil {
+		return nil, err
+	}
+	var f = &routeFilter{
+		sources:        toSet(filters.Sources),
+		excludeSources: toSet(filters.ExcludeSources),
+		processTypes:   toSet(filters.ProcessTypes),
+	}
+	if filters.MinSeverity != "" {
+		severity, _ := syslog.Severity(filters.MinSeverity)
+		f.minSeverity = &severity
+	}
+	if filters.Include != "" {
+		f.include = regexp.MustCompile(filters.Include)
+	}
+	if filters.Exclude != "" {
+		f.exclude = regexp.MustCompile(filters.Exclude)
+	}
+	return f, nil
+}
+
+// LogSource returns the source (app, router or build) of a log.
+func LogSource(message events.LogSpec) string {
+	switch message.Kubernetes.PodName {
+	case "akkeris/router":
+		return "router"
+	case "akkeris/build":
+		return "build"
+	}
+	return "app"
+}
+
+// allows checks a log against the filter, process types only apply to app
+// logs. A nil filter allows everything.
+func (f *routeFilter) allows(source string, procType string, severity syslog.Priority, message string) bool {
+	if f == nil {
+		return true
+	}
+	if f.sources != nil && !f.sources[source] {
+		return false
+	}
+	if f.excludeSources[source] {
+		return false
+	}
+	if f.processTypes != nil && source == "app" && !f.processTypes[procType] {
+		return false
+	}
+	// lower priorities are more severe.
+	if f.minSeverity != nil && severity > *f.minSeverity {
+		return false
+	}
+	if f.include != nil && !f.include.MatchString(message) {
+		return false
+	}
+	if f.exclude != nil && f.exclude.MatchString(message) {
+		return false
+	}
+	return true
+}
@@ -0,0 +1,45 @@
+package shuttle
+
+import (
+	"github.com/akkeris/logshuttle/events"
+	"github.com/akkeris/logshuttle/storage"
+	"github.com/akkeris/logshuttle/syslog"
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+)
+
+func TestRouteFilters(t *testing.T) {
+	Convey("Ensure routes without filters allow everything.", t, func() {
+		f, err := compileRouteFilter(nil)
+		So(err, ShouldEqual, nil)
+		So(f.allows("router", "web", syslog.SevDebug, "anything"), ShouldEqual, true)
+	})
+	Convey("Ensure sources and process types are filtered.", t, func() {
+		f, err := compileRouteFilter(&storage.RouteFilters{ExcludeSources: []string{"build"}, ProcessTypes: []string{"worker"}})
+		So(err, ShouldEqual, nil)
+		So(f.allows("build", "web", syslog.SevInfo, "Step 1/2"), ShouldEqual, false)
+		So(f.allows("app", "web", syslog.SevInfo, "hello"), ShouldEqual, false)
+		So(f.allows("app", "worker", syslog.SevInfo, "hello"), ShouldEqual, true)
+		So(f.allows("router", "web", syslog.SevInfo, "status=200"), ShouldEqual, true)
+		So(LogSource(events.LogSpec{Kubernetes: events.KubernetesSpec{PodName: "akkeris/router"}}), ShouldEqual, "router")
+	})
+	Convey("Ensure severity and patterns are filtered.", t, func() {
+		f, err := compileRouteFilter(&storage.RouteFilters{MinSeverity: "err", Exclude: `path=/health`})
+		So(err, ShouldEqual, nil)
+		So(f.allows("app", "web", syslog.SevInfo, "hello"), ShouldEqual, false)
+		So(f.allows("app", "web", syslog.SevErr, "oops"), ShouldEqual, true)
+		So(f.allows("router", "web", syslog.SevErr, "status=500 path=/health"), ShouldEqual, false)
+		f, err = compileRouteFilter(&storage.RouteFilters{Include: `status=5\d\d`})
+		So(err, ShouldEqual, nil)
+		So(f.allows("router", "web", syslog.SevInfo, "status=200"), ShouldEqual, false)
+		So(f.allows("router", "web", syslog.SevInfo, "status=503"), ShouldEqual, true)
+	})
+	Convey("Ensure invalid filters are rejected.", t, func() {
+		_, err := compileRouteFilter(&storage.RouteFilters{Sources: []string{"istio"}})
+		So(err, ShouldNotEqual, nil)
+		_, err = compileRouteFilter(&storage.RouteFilters{MinSeverity: "loud"})
+		So(err, ShouldNotEqual, nil)
+		_, err = compileRouteFilter(&storage.RouteFilters{Exclude: `(`})
+		So(err, ShouldNotEqual, nil)
+	})
+}
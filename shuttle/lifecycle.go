@@ -0,0 +1,84 @@
+package shuttle
+
+import (
+	"github.com/akkeris/logshuttle/events"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var lifecycleReason = regexp.MustCompile(`\breason=(\S+)`)
+var lifecycleExitCode = regexp.MustCompile(`\bexitCode=(\d+)`)
+var lifecycleMessage = regexp.MustCompile(`\bmessage=(.*)$`)
+
+// ParseLifecycleEvent converts a kubernetes "Phase: " log line into a
+// lifecycle event, nil is returned if the line isn't one. For example:
+//
+//	Phase: Creating -- Creating pod blog-1050769379-6ktnc
+//	Phase: Pending/waiting --  reason=ContainerCreating
+//	Phase: Running/waiting --  reason=CrashLoopBackOff message=Back-off 5m0s restarting failed container...
+//	Phase: Running/running --  startedAt=2017-06-16T16:16:30
+//	Phase: Running/terminated --  reason=Error startedAt=... finishedAt=... exitCode=137
+//	Phase: Failed/ --  reason=Evicted message=The node was low on resource: memory.
+//	Phase: Deleting -- pod blog-472348638-9tzlx in space default
+func ParseLifecycleEvent(message string) *events.LifecycleEvent {
+	if !strings.HasPrefix(message, "Phase: ") {
+		return nil
+	}
+	var parts = strings.SplitN(strings.TrimPrefix(message, "Phase: "), " --", 2)
+	var phase = strings.TrimSpace(parts[0])
+	var details = ""
+	if len(parts) == 2 {
+		details = parts[1]
+	}
+	var event = events.LifecycleEvent{}
+	if m := lifecycleReason.FindStringSubmatch(details); m != nil {
+		event.Reason = m[1]
+	}
+	if m := lifecycleMessage.FindStringSubmatch(details); m != nil {
+		event.Message = strings.TrimSpace(m[1])
+	}
+	if m := lifecycleExitCode.FindStringSubmatch(details); m != nil {
+		if code, err := strconv.Atoi(m[1]); err == nil {
+			event.ExitCode = &code
+		}
+	}
+
+	switch {
+	case phase == "Creating":
+		event.Type = events.LifecycleCreated
+	case phase == "Deleting":
+		event.Type = events.LifecycleDeleted
+	case event.Reason == "Evicted":
+		event.Type = events.LifecycleEvicted
+	case event.Reason == "OOMKilled":
+		event.Type = events.LifecycleOOMKilled
+	case strings.HasPrefix(phase, "Pending/"):
+		event.Type = events.LifecycleScheduled
+	case phase == "Running/waiting" && event.Reason == "CrashLoopBackOff":
+		event.Type = events.LifecycleCrashed
+	case phase == "Running/waiting":
+		event.Type = events.LifecycleScheduled
+	case phase == "Running/running":
+		event.Type = events.LifecycleStarted
+	case strings.HasSuffix(phase, "/terminated"):
+		event.Type = events.LifecycleExited
+	default:
+		return nil
+	}
+	return &event
+}
+
+// AppLogMessage returns the line to send for an app log, lifecycle events
+// (structured or kubernetes "Phase: " lines) are made human readable. The
+// lifecycle event is returned so callers can tell if it was an error.
+func AppLogMessage(msg events.LogSpec) (string, *events.LifecycleEvent) {
+	var event = msg.Lifecycle
+	if event == nil {
+		event = ParseLifecycleEvent(msg.Log)
+	}
+	if event == nil {
+		return msg.Log, nil
+	}
+	return event.String(), event
+}
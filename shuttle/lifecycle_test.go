@@ -0,0 +1,38 @@
+package shuttle
+
+import (
+	"github.com/akkeris/logshuttle/events"
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+)
+
+func TestLifecycleEvents(t *testing.T) {
+	Convey("Ensure kubernetes phases are converted to lifecycle events.", t, func() {
+		So(ParseLifecycleEvent("Phase: Creating -- Creating pod blog-1050769379-6ktnc").String(), ShouldEqual, "Creating Dyno")
+		So(ParseLifecycleEvent("Phase: Pending/waiting --  reason=ContainerCreating").String(), ShouldEqual, "Waiting on Dyno")
+		So(ParseLifecycleEvent("Phase: Running/running --  startedAt=2017-06-16T16:16:30").String(), ShouldEqual, "Checking Dyno Health")
+		So(ParseLifecycleEvent("Phase: Deleting -- pod blog-472348638-9tzlx in space default").String(), ShouldEqual, "Deleting Dyno")
+		crashed := ParseLifecycleEvent("Phase: Running/waiting --  reason=CrashLoopBackOff message=Back-off 5m0s restarting failed container=useraccount")
+		So(crashed.Type, ShouldEqual, events.LifecycleCrashed)
+		So(crashed.String(), ShouldEqual, `at=error code=H10 desc="App crashed"`)
+		So(ParseLifecycleEvent("Not a phase"), ShouldEqual, nil)
+	})
+	Convey("Ensure exit codes and causes are reported.", t, func() {
+		So(ParseLifecycleEvent("Phase: Running/terminated --  reason=Completed startedAt=2017-06-16T16:12:39Z exitCode=0").String(), ShouldEqual, "Dyno exited (exit code 0)")
+		So(ParseLifecycleEvent("Phase: Running/terminated --  reason=Error exitCode=10").String(), ShouldEqual, "Dyno exited (exit code 10)")
+		So(ParseLifecycleEvent("Phase: Running/terminated --  reason=Error exitCode=137").String(), ShouldEqual, "Dyno exited (exit code 137, SIGKILL)")
+		oom := ParseLifecycleEvent("Phase: Running/terminated --  reason=OOMKilled exitCode=137")
+		So(oom.Code(), ShouldEqual, "R14")
+		So(oom.IsError(), ShouldEqual, true)
+		evicted := ParseLifecycleEvent("Phase: Failed/ --  reason=Evicted message=The node was low on resource: memory.")
+		So(evicted.String(), ShouldEqual, `at=error desc="Dyno evicted: The node was low on resource: memory."`)
+	})
+	Convey("Ensure structured lifecycle events take precedence over the log.", t, func() {
+		text, event := AppLogMessage(events.LogSpec{Log: "anything", Lifecycle: &events.LifecycleEvent{Type: events.LifecycleBootTimeout}})
+		So(text, ShouldEqual, `at=error code=R10 desc="Boot timeout"`)
+		So(event.IsError(), ShouldEqual, true)
+		text, event = AppLogMessage(events.LogSpec{Log: "hello"})
+		So(text, ShouldEqual, "hello")
+		So(event, ShouldEqual, nil)
+	})
+}
@@ -0,0 +1,122 @@
+package shuttle
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// A LogfmtPair is a single key and value from a logfmt line, bare keys (those
+// without an "=") have an empty value.
+type LogfmtPair struct {
+	Key   string
+	Value string
+	Bare  bool
+}
+
+// A LogfmtError describes which field of a logfmt line could not be parsed.
+type LogfmtError struct {
+	Key    string
+	Offset int
+	Reason string
+}
+
+func (e *LogfmtError) Error() string {
+	if e.Key == "" {
+		return fmt.Sprintf("logfmt: %s at offset %d", e.Reason, e.Offset)
+	}
+	return fmt.Sprintf("logfmt: %s in field %q at offset %d", e.Reason, e.Key, e.Offset)
+}
+
+func isLogfmtSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\r' || c == '\n'
+}
+
+// ParseLogfmt splits a logfmt line (key=value key="quoted value" key) into
+// its pairs in the order they appear. Quoted values may contain spaces and
+// go style escapes (\" \\ \n etc).
+func ParseLogfmt(line string) ([]LogfmtPair, error) {
+	var pairs = make([]LogfmtPair, 0)
+	var i = 0
+	for i < len(line) {
+		for i < len(line) && isLogfmtSpace(line[i]) {
+			i++
+		}
+		if i == len(line) {
+			break
+		}
+		var start = i
+		for i < len(line) && line[i] != '=' && !isLogfmtSpace(line[i]) {
+			if line[i] == '"' {
+				return nil, &LogfmtError{Key: line[start:i], Offset: i, Reason: "unexpected quote in key"}
+			}
+			i++
+		}
+		var key = line[start:i]
+		if key == "" {
+			return nil, &LogfmtError{Offset: i, Reason: "missing key"}
+		}
+		if i == len(line) || isLogfmtSpace(line[i]) {
+			pairs = append(pairs, LogfmtPair{Key: key, Bare: true})
+			continue
+		}
+		// skip the "="
+		i++
+		if i < len(line) && line[i] == '"' {
+			var end = i + 1
+			for end < len(line) && line[end] != '"' {
+				if line[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(line) {
+				return nil, &LogfmtError{Key: key, Offset: i, Reason: "unterminated quoted value"}
+			}
+			value, err := strconv.Unquote(line[i : end+1])
+			if err != nil {
+				// Not every escape is valid in go, keep the raw contents.
+				value = line[i+1 : end]
+			}
+			i = end + 1
+			if i < len(line) && !isLogfmtSpace(line[i]) {
+				return nil, &LogfmtError{Key: key, Offset: i, Reason: "unexpected character after quoted value"}
+			}
+			pairs = append(pairs, LogfmtPair{Key: key, Value: value})
+		} else {
+			var vstart = i
+			for i < len(line) && !isLogfmtSpace(line[i]) {
+				i++
+			}
+			pairs = append(pairs, LogfmtPair{Key: key, Value: line[vstart:i]})
+		}
+	}
+	return pairs, nil
+}
+
+// FormatLogfmtValue quotes a value if it contains spaces, quotes, equal signs
+// or control characters so it can be parsed back out of a logfmt line.
+func FormatLogfmtValue(value string) string {
+	if value == "" {
+		return "\"\""
+	}
+	for i := 0; i < len(value); i++ {
+		if value[i] <= ' ' || value[i] == '"' || value[i] == '=' || value[i] == '\\' || value[i] >= 0x7f {
+			return strconv.Quote(value)
+		}
+	}
+	return value
+}
+
+// FormatLogfmt writes the pairs back out as a logfmt line.
+func FormatLogfmt(pairs []LogfmtPair) string {
+	var parts = make([]string, 0, len(pairs))
+	for _, pair := range pairs {
+		if pair.Bare {
+			parts = append(parts, pair.Key)
+		} else {
+			parts = append(parts, pair.Key+"="+FormatLogfmtValue(pair.Value))
+		}
+	}
+	return strings.Join(parts, " ")
+}
@@ -0,0 +1,34 @@
+//go:build go1.18
+// +build go1.18
+
+package shuttle
+
+import (
+	"reflect"
+	"testing"
+)
+
+// Web logs are untrusted client input, the seed corpus is in
+// testdata/fuzz/FuzzParseLogfmt, run with: go test -fuzz FuzzParseLogfmt ./shuttle
+func FuzzParseLogfmt(f *testing.F) {
+	f.Add(`hostname=app-space.example.com source=1.1.1.1 path=/ status=200`)
+	f.Add(`user_agent="Mozilla/5.0 (X11; Linux x86_64)" path="/with space"`)
+	f.Fuzz(func(t *testing.T, line string) {
+		pairs, err := ParseLogfmt(line)
+		ParseWebLog([]byte(line))
+		if err != nil {
+			if _, ok := err.(*LogfmtError); !ok {
+				t.Fatalf("unexpected error type %T", err)
+			}
+			return
+		}
+		// Anything that parses must survive being formatted and parsed again.
+		reparsed, err := ParseLogfmt(FormatLogfmt(pairs))
+		if err != nil {
+			t.Fatalf("unable to reparse %q: %s", FormatLogfmt(pairs), err)
+		}
+		if !reflect.DeepEqual(pairs, reparsed) {
+			t.Fatalf("round trip of %q differs: %#v != %#v", line, pairs, reparsed)
+		}
+	})
+}
@@ -0,0 +1,46 @@
+package shuttle
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+)
+
+func TestLogfmt(t *testing.T) {
+	Convey("Ensure quoted values with spaces and escapes are parsed.", t, func() {
+		pairs, err := ParseLogfmt(`method=GET user_agent="Mozilla/5.0 (X11; Linux) \"quoted\"" path="/some path" bytes=10`)
+		So(err, ShouldEqual, nil)
+		So(len(pairs), ShouldEqual, 4)
+		So(pairs[1].Key, ShouldEqual, "user_agent")
+		So(pairs[1].Value, ShouldEqual, `Mozilla/5.0 (X11; Linux) "quoted"`)
+		So(pairs[2].Value, ShouldEqual, "/some path")
+		So(pairs[3].Value, ShouldEqual, "10")
+	})
+	Convey("Ensure bare keys and empty values are kept.", t, func() {
+		pairs, err := ParseLogfmt(`cached status= other=""`)
+		So(err, ShouldEqual, nil)
+		So(len(pairs), ShouldEqual, 3)
+		So(pairs[0].Bare, ShouldEqual, true)
+		So(pairs[1].Value, ShouldEqual, "")
+		So(FormatLogfmt(pairs), ShouldEqual, `cached status="" other=""`)
+	})
+	Convey("Ensure the failing field is reported.", t, func() {
+		_, err := ParseLogfmt(`method=GET user_agent="Mozilla/5.0 bytes=10`)
+		So(err, ShouldNotEqual, nil)
+		So(err.(*LogfmtError).Key, ShouldEqual, "user_agent")
+		_, err = ParseLogfmt(`method=GET path="/a"b`)
+		So(err.(*LogfmtError).Key, ShouldEqual, "path")
+	})
+	Convey("Ensure web logs with quoted values are not dropped.", t, func() {
+		msg, err := ParseWebLog([]byte(`hostname=app-space.example.com source=1.1.1.1 path="/some path" user_agent="curl/7.1 (linux)" status=200 timestamp=2020-01-01T00:00:00Z`))
+		So(err, ShouldEqual, nil)
+		So(msg.Kubernetes.ContainerName, ShouldEqual, "app")
+		So(msg.Topic, ShouldEqual, "space")
+		So(msg.Path, ShouldEqual, "/some path")
+		So(msg.Log, ShouldEqual, `fwd="1.1.1.1" user_agent="curl/7.1 (linux)" status=200`)
+	})
+	Convey("Ensure web logs without a hostname report the field.", t, func() {
+		_, err := ParseWebLog([]byte(`source=1.1.1.1 status=200`))
+		So(err, ShouldNotEqual, nil)
+		So(err.(*LogfmtError).Key, ShouldEqual, "hostname")
+	})
+}
@@ -0,0 +1,51 @@
+package shuttle
+
+import (
+	"github.com/akkeris/logshuttle/events"
+	"github.com/akkeris/logshuttle/syslog"
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+	"time"
+)
+
+func TestParseLogplexPacket(t *testing.T) {
+	Convey("Ensure logplex packets are turned back into the log specs they came from.", t, func() {
+		var when = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+		var tests = []struct {
+			packet    syslog.Packet
+			key       string
+			container string
+			pod       string
+			space     string
+			stream    string
+		}{
+			{syslog.Packet{Severity: syslog.SevInfo, Hostname: "app-space", Tag: "web.1234-abcd"}, "", "app", "app-1234-abcd", "space", "stdout"},
+			{syslog.Packet{Severity: syslog.SevErr, Hostname: "app-space", Tag: "worker.2"}, "", "app--worker", "app-2", "space", "stderr"},
+			{syslog.Packet{Severity: syslog.SevWarning, Hostname: "app-space", Tag: "web"}, "", "app", "app", "space", "stdout"},
+			{syslog.Packet{Severity: syslog.SevInfo, Hostname: "app-space", Tag: "akkeris/router"}, "", "app", "akkeris/router", "space", "stdout"},
+			// the key given in the request wins over the packet's hostname.
+			{syslog.Packet{Severity: syslog.SevInfo, Hostname: "somehost", Tag: "web.1"}, "other-space-with-dashes", "other", "other-1", "space-with-dashes", "stdout"},
+		}
+		for _, test := range tests {
+			test.packet.Time = when
+			test.packet.Message = "hello"
+			var msg events.LogSpec
+			So(ParseLogplexPacket(test.packet, test.key, &msg), ShouldEqual, false)
+			So(msg.Log, ShouldEqual, "hello")
+			So(msg.Time, ShouldResemble, when)
+			So(msg.Stream, ShouldEqual, test.stream)
+			So(msg.Kubernetes.ContainerName, ShouldEqual, test.container)
+			So(msg.Kubernetes.PodName, ShouldEqual, test.pod)
+			So(msg.Topic, ShouldEqual, test.space)
+			So(msg.Space, ShouldEqual, test.space)
+			So(msg.Kubernetes.NamespaceName, ShouldEqual, test.space)
+		}
+	})
+	Convey("Ensure logplex packets without an app and space are dropped.", t, func() {
+		var keys = []string{"app", "-space", "app-", ""}
+		for _, key := range keys {
+			var msg events.LogSpec
+			So(ParseLogplexPacket(syslog.Packet{Hostname: key, Tag: "web.1", Message: "hello"}, key, &msg), ShouldEqual, true)
+		}
+	})
+}
@@ -0,0 +1,201 @@
+package shuttle
+
+import (
+	"encoding/json"
+	"github.com/akkeris/logshuttle/events"
+	"log"
+	"os"
+	"regexp"
+	"sync"
+)
+
+// A Parser turns a raw kafka message into a log spec.
+type Parser func([]byte) (events.LogSpec, error)
+
+// LogKind determines how a parsed log line is delivered to drains and sessions.
+type LogKind int
+
+const (
+	// AppLog lines are delivered to the app (and process) that produced them.
+	AppLog LogKind = iota
+	// RouterLog lines are delivered to the app and, if set, the site they were for.
+	RouterLog
+	// BuildLog lines are delivered to the app that was built.
+	BuildLog
+)
+
+type ParserRegistration struct {
+	Kind         LogKind
+	Parser       Parser
+	subscription string
+	match        func(topic string) bool
+}
+
+// A ParserRegistry binds topics (or topic patterns) to the parser for the
+// messages within them. Exact topics take precedence over patterns, patterns
+// are matched in the order they were registered. The shuttle subscribes to the
+// registered topics when it starts, so parsers can't be registered after that.
+type ParserRegistry struct {
+	mutex         sync.Mutex
+	started       bool
+	topics        map[string]*ParserRegistration
+	registrations []*ParserRegistration
+}
+
+func NewParserRegistry() *ParserRegistry {
+	return &ParserRegistry{topics: make(map[string]*ParserRegistration), registrations: make([]*ParserRegistration, 0)}
+}
+
+// Register binds a parser to a single topic.
+func (pr *ParserRegistry) Register(topic string, kind LogKind, parser Parser) {
+	pr.mutex.Lock()
+	defer pr.mutex.Unlock()
+	pr.checkNotStarted(topic)
+	reg := &ParserRegistration{Kind: kind, Parser: parser, subscription: topic, match: func(t string) bool { return t == topic }}
+	if _, ok := pr.topics[topic]; !ok {
+		pr.registrations = append(pr.registrations, reg)
+	} else {
+		for i, r := range pr.registrations {
+			if r == pr.topics[topic] {
+				pr.registrations[i] = reg
+			}
+		}
+	}
+	pr.topics[topic] = reg
+}
+
+// RegisterPattern binds a parser to every topic matching the pattern.
+func (pr *ParserRegistry) RegisterPattern(pattern *regexp.Regexp, kind LogKind, parser Parser) {
+	var subscription = pattern.String()
+	if subscription == "" || subscription[0] != '^' {
+		subscription = "^.*" + subscription
+	}
+	pr.RegisterMatch(subscription, pattern.MatchString, kind, parser)
+}
+
+// RegisterMatch binds a parser to every topic the match function accepts, the
+// subscription is the topic or "^" prefixed pattern kafka should subscribe to
+// receive those topics.
+func (pr *ParserRegistry) RegisterMatch(subscription string, match func(topic string) bool, kind LogKind, parser Parser) {
+	pr.mutex.Lock()
+	defer pr.mutex.Unlock()
+	pr.checkNotStarted(subscription)
+	pr.registrations = append(pr.registrations, &ParserRegistration{Kind: kind, Parser: parser, subscription: subscription, match: match})
+}
+
+func (pr *ParserRegistry) checkNotStarted(subscription string) {
+	if pr.started {
+		panic("shuttle: parser for " + subscription + " registered after the shuttle started")
+	}
+}
+
+// start marks the registry as in use by a shuttle, see checkNotStarted.
+func (pr *ParserRegistry) start() {
+	pr.mutex.Lock()
+	defer pr.mutex.Unlock()
+	pr.started = true
+}
+
+// Lookup finds the registration for a topic, nil if none handle it.
+func (pr *ParserRegistry) Lookup(topic string) *ParserRegistration {
+	pr.mutex.Lock()
+	defer pr.mutex.Unlock()
+	if reg, ok := pr.topics[topic]; ok {
+		return reg
+	}
+	for _, reg := range pr.registrations {
+		if reg.match(topic) {
+			return reg
+		}
+	}
+	return nil
+}
+
+// Registrations returns every registration in the order they were added.
+func (pr *ParserRegistry) Registrations() []*ParserRegistration {
+	pr.mutex.Lock()
+	defer pr.mutex.Unlock()
+	return append([]*ParserRegistration{}, pr.registrations...)
+}
+
+// Subscription returns the topics and patterns kafka must subscribe to.
+func (pr *ParserRegistry) Subscription() []string {
+	var subscription = make([]string, 0)
+	for _, reg := range pr.Registrations() {
+		subscription = append(subscription, reg.subscription)
+	}
+	return subscription
+}
+
+// IsPattern returns whether the registration's subscription is a pattern
+// rather than a single topic.
+func (reg *ParserRegistration) IsPattern() bool {
+	return len(reg.subscription) > 0 && reg.subscription[0] == '^'
+}
+
+func (reg *ParserRegistration) Subscription() string {
+	return reg.subscription
+}
+
+// ParserFunc adapts the parse functions in this package to a Parser.
+func ParserFunc(parse func([]byte, *events.LogSpec) error) Parser {
+	return func(data []byte) (events.LogSpec, error) {
+		var msg events.LogSpec
+		err := parse(data, &msg)
+		return msg, err
+	}
+}
+
+// ParseAppLog decodes a log spec produced by fluentd (or /log-events).
+func ParseAppLog(data []byte) (events.LogSpec, error) {
+	var msg events.LogSpec
+	err := json.Unmarshal(data, &msg)
+	return msg, err
+}
+
+var defaultParsers *ParserRegistry
+var defaultParsersOnce sync.Once
+
+// DefaultParsers returns the registry used by the shuttle and sessions, it
+// contains the app, web, istio and build log sources. Custom sources can be
+// added to it before the shuttle or session server starts.
+func DefaultParsers() *ParserRegistry {
+	defaultParsersOnce.Do(func() {
+		defaultParsers = newDefaultParsers()
+	})
+	return defaultParsers
+}
+
+func newDefaultParsers() *ParserRegistry {
+	topics := events.Topics()
+	parsers := NewParserRegistry()
+	formats, err := WebLogFormats()
+	if err != nil {
+		log.Fatalf("Fatal: Invalid web log formats: %s\n", err)
+	}
+	if _, ok := formats[topics.WebLogs]; !ok {
+		formats[topics.WebLogs] = WebLogFormatLogfmt
+	}
+	for topic, format := range formats {
+		parser, _ := WebLogParser(format)
+		parsers.Register(topic, RouterLog, parser)
+	}
+	if os.Getenv("RUN_ISTIO_ALS") == "true" {
+		var parser = ParserFunc(ParseIstioFromEnvoyWebLogMessage)
+		if os.Getenv("RUN_ISTIO_ALS_DEBUG") == "true" {
+			parser = func(data []byte) (events.LogSpec, error) {
+				msg, err := ParserFunc(ParseIstioFromEnvoyWebLogMessage)(data)
+				if err != nil {
+					log.Printf("Unable to decode message from kafka: %s\n", data)
+				}
+				return msg, err
+			}
+		}
+		parsers.Register(topics.IstioWebLogs, RouterLog, parser)
+	} else {
+		parsers.Register(topics.IstioWebLogs, RouterLog, ParserFunc(ParseIstioWebLogMessage))
+	}
+	parsers.Register(topics.BuildLogs, BuildLog, ParserFunc(ParseBuildLogMessage))
+	parsers.RegisterMatch(topics.AppSubscription(), topics.IsAppTopic, AppLog, ParseAppLog)
+	return parsers
+}
@@ -0,0 +1,51 @@
+package shuttle
+
+import (
+	"github.com/akkeris/logshuttle/events"
+	kafka "github.com/confluentinc/confluent-kafka-go/kafka"
+	. "github.com/smartystreets/goconvey/convey"
+	"sync"
+	"testing"
+)
+
+func TestParserErrors(t *testing.T) {
+	Convey("Ensure parsers report which field of a message couldn't be parsed.", t, func() {
+		var envoy = `{"common_properties":{"upstream_cluster":"outbound|80||app.space.svc.cluster.local","time_to_last_rx_byte":"1ms","time_to_last_upstream_tx_byte":"1ms","time_to_last_upstream_rx_byte":"2ms","time_to_last_downstream_tx_byte":"3ms"},"request":{"request_method":"GET","path":"/"},"response":{"response_code":200}}`
+		var tests = []struct {
+			parser Parser
+			data   string
+			err    string
+		}{
+			{ParserFunc(ParseIstioFromEnvoyWebLogMessage), `not json`, "istio: invalid character"},
+			{ParserFunc(ParseIstioFromEnvoyWebLogMessage), `{}`, "istio: missing common_properties"},
+			{ParserFunc(ParseIstioFromEnvoyWebLogMessage), `{"common_properties":{}}`, "istio: missing request"},
+			{ParserFunc(ParseIstioFromEnvoyWebLogMessage), `{"common_properties":{},"request":{},"response":{}}`, "istio: missing response.response_code"},
+			{ParserFunc(ParseIstioFromEnvoyWebLogMessage), `{"common_properties":{"time_to_last_rx_byte":"1ms"},"request":{},"response":{"response_code":200}}`, "istio: missing common_properties.time_to_last_upstream_tx_byte"},
+			{ParserFunc(ParseIstioFromEnvoyWebLogMessage), `{"common_properties":{"upstream_cluster":"outbound|80||app","time_to_last_rx_byte":"1ms","time_to_last_upstream_tx_byte":"1ms","time_to_last_upstream_rx_byte":"2ms","time_to_last_downstream_tx_byte":"3ms"},"request":{},"response":{"response_code":200}}`, `istio: common_properties.upstream_cluster "outbound|80||app" has no app and space`},
+			{ParserFunc(ParseIstioFromEnvoyWebLogMessage), envoy, ""},
+			{ParserFunc(ParseIstioWebLogMessage), `{"bytes":"ten"}`, "istio: json: cannot unmarshal string"},
+			{ParserFunc(ParseBuildLogMessage), `{"metadata":"-space","message":"built"}`, `build: metadata "-space" has no app and space`},
+			{ParserFunc(ParseBuildLogMessage), `{"metadata":"app-space","message":"built"}`, ""},
+			{ParserFunc(ParseWebLogMessage), `path=/ status=200`, `logfmt: missing or invalid app-space in field "hostname" at offset 0`},
+			{ParserFunc(ParseWebLogMessage), `hostname=app-space.example.com path=/ status=200`, ""},
+		}
+		for _, test := range tests {
+			_, err := test.parser([]byte(test.data))
+			if test.err == "" {
+				So(err, ShouldBeNil)
+			} else {
+				So(err, ShouldNotBeNil)
+				So(err.Error(), ShouldStartWith, test.err)
+			}
+		}
+	})
+	Convey("Ensure the parser's error is recorded with the failed message.", t, func() {
+		shuttle := Shuttle{failed_mutex: &sync.Mutex{}, routes_mutex: &sync.Mutex{}}
+		var topic = events.Topics().BuildLogs
+		reg := &ParserRegistration{Kind: BuildLog, Parser: ParserFunc(ParseBuildLogMessage), subscription: topic}
+		shuttle.forwardParsedLog(reg, &kafka.Message{TopicPartition: kafka.TopicPartition{Topic: &topic}, Value: []byte(`{"metadata":""}`)})
+		failed := shuttle.FailedMessages(1)
+		So(len(failed), ShouldEqual, 1)
+		So(failed[0].Error, ShouldEqual, `build: metadata "" has no app and space`)
+	})
+}
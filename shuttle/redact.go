@@ -0,0 +1,207 @@
+package shuttle
+
+import (
+	"github.com/akkeris/logshuttle/storage"
+	"log"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const redacted = "[redacted]"
+
+type redaction struct {
+	name        string
+	pattern     *regexp.Regexp
+	replacement string
+	// valid optionally confirms a match is a secret before it's replaced.
+	valid func(match string) bool
+}
+
+func (r redaction) apply(message string) string {
+	if r.valid == nil {
+		return r.pattern.ReplaceAllString(message, r.replacement)
+	}
+	return r.pattern.ReplaceAllStringFunc(message, func(match string) string {
+		if !r.valid(match) {
+			return match
+		}
+		return r.pattern.ReplaceAllString(match, r.replacement)
+	})
+}
+
+// The rules applied to every log line, unless they're disabled by name.
+var builtinRedactions = []redaction{
+	// Docker build arguments, e.g., "Step 3/9 : ARG NPM_TOKEN=abc"
+	{name: "build_args", pattern: regexp.MustCompile(`(Step \d+/\d+ : ARG [0-9A-Za-z_]+=).*`), replacement: "${1}" + redacted},
+	// Authorization headers, e.g., "Authorization: Bearer abc", and elsewhere
+	// only long tokens with a digit so prose ("the bearer of bad news") is left
+	{name: "bearer", pattern: regexp.MustCompile(`(?i)(authorization["']?\s*[:=]\s*["']?bearer\s+)[A-Za-z0-9\-._~+/]+=*`), replacement: "${1}" + redacted},
+	{name: "bearer", pattern: regexp.MustCompile(`(?i)(\bbearer\s+)[A-Za-z0-9\-._~+/]{20,}=*`), replacement: "${1}" + redacted, valid: hasDigit},
+	// AWS access key ids and secret access keys
+	{name: "aws", pattern: regexp.MustCompile(`\b(?:AKIA|ASIA)[0-9A-Z]{16}\b`), replacement: redacted},
+	{name: "aws", pattern: regexp.MustCompile(`(?i)(aws_secret_access_key["']?\s*[=:]\s*["']?)[A-Za-z0-9/+=]{40}`), replacement: "${1}" + redacted},
+	// Credit card numbers, only if they have a card network's prefix and length
+	// and pass the luhn check
+	{name: "cards", pattern: regexp.MustCompile(`\b(?:\d[ -]?){12,18}\d\b`), replacement: redacted, valid: isCardNumber},
+}
+
+// enabledRedactions are the built in rules less those named in
+// REDACTION_DISABLED_BUILTINS (comma separated, or "all").
+var enabledRedactions = builtinRedactionsExcept(os.Getenv("REDACTION_DISABLED_BUILTINS"))
+
+func builtinRedactionsExcept(disabled string) []redaction {
+	var names = make(map[string]bool)
+	for _, name := range strings.Split(disabled, ",") {
+		names[strings.TrimSpace(name)] = true
+	}
+	var enabled = make([]redaction, 0, len(builtinRedactions))
+	for _, rule := range builtinRedactions {
+		if !names["all"] && !names[rule.name] {
+			enabled = append(enabled, rule)
+		}
+	}
+	return enabled
+}
+
+func hasDigit(match string) bool {
+	return strings.IndexAny(match, "0123456789") != -1
+}
+
+// A card network's number prefixes (IIN ranges, inclusive) and the lengths of
+// its numbers.
+type cardNetwork struct {
+	low     int
+	high    int
+	lengths []int
+}
+
+// Visa, Mastercard, American Express, Discover, Diners Club and JCB, prefixes
+// are compared with the same number of leading digits.
+var cardNetworks = []cardNetwork{
+	{4, 4, []int{13, 16, 19}},
+	{51, 55, []int{16}},
+	{2221, 2720, []int{16}},
+	{34, 34, []int{15}},
+	{37, 37, []int{15}},
+	{6011, 6011, []int{16, 17, 18, 19}},
+	{644, 649, []int{16, 17, 18, 19}},
+	{65, 65, []int{16, 17, 18, 19}},
+	{300, 305, []int{14, 15, 16, 17, 18, 19}},
+	{36, 36, []int{14, 15, 16, 17, 18, 19}},
+	{38, 39, []int{14, 15, 16, 17, 18, 19}},
+	{3528, 3589, []int{16, 17, 18, 19}},
+}
+
+// isCardNumber checks a (possibly space or dash separated) number has a card
+// network's prefix and length and passes the luhn check, so other long
+// numbers such as timestamps and ids aren't mistaken for cards.
+func isCardNumber(number string) bool {
+	var digits = strings.Map(func(r rune) rune {
+		if r < '0' || r > '9' {
+			return -1
+		}
+		return r
+	}, number)
+	for _, network := range cardNetworks {
+		var width = len(strconv.Itoa(network.low))
+		prefix, err := strconv.Atoi(digits[0:width])
+		if err != nil || prefix < network.low || prefix > network.high {
+			continue
+		}
+		for _, length := range network.lengths {
+			if len(digits) == length {
+				return isLuhn(digits)
+			}
+		}
+	}
+	return false
+}
+
+// isLuhn checks the digits of a number with the luhn algorithm credit card
+// numbers use.
+func isLuhn(number string) bool {
+	var sum = 0
+	var double = false
+	for i := len(number) - 1; i >= 0; i-- {
+		var digit = int(number[i] - '0')
+		if double {
+			digit = digit * 2
+			if digit > 9 {
+				digit = digit - 9
+			}
+		}
+		sum = sum + digit
+		double = !double
+	}
+	return sum%10 == 0
+}
+
+// A Redactor masks secrets in log lines before they're sent to a drain or
+// session, with the built in rules and any custom rules for the app.
+type Redactor struct {
+	apps map[string][]redaction
+}
+
+// NewRedactor compiles the custom rules, rules that don't compile are logged
+// and skipped.
+func NewRedactor(rules []storage.RedactionRule) *Redactor {
+	var r = &Redactor{apps: make(map[string][]redaction)}
+	for _, rule := range rules {
+		pattern, err := regexp.Compile(rule.Pattern)
+		if err != nil {
+			log.Printf("[redact] Skipping invalid redaction rule %s for %s-%s: %s\n", rule.Id, rule.App, rule.Space, err)
+			continue
+		}
+		var replacement = rule.Replacement
+		if replacement == "" {
+			replacement = redacted
+		}
+		var key = rule.App + "-" + rule.Space
+		r.apps[key] = append(r.apps[key], redaction{pattern: pattern, replacement: replacement})
+	}
+	return r
+}
+
+// LoadRedactor creates a redactor with the custom rules in storage.
+func LoadRedactor(client *storage.Storage) (*Redactor, error) {
+	rules, err := (*client).GetRedactionRules()
+	if err != nil {
+		return nil, err
+	}
+	return NewRedactor(rules), nil
+}
+
+// Redact masks secrets in the message, app may be an app or app--proc (the
+// kubernetes container name). A nil redactor applies only the built in rules.
+func (r *Redactor) Redact(app string, space string, message string) string {
+	for _, rule := range enabledRedactions {
+		message = rule.apply(message)
+	}
+	if r == nil {
+		return message
+	}
+	if i := strings.Index(app, "--"); i != -1 {
+		app = app[0:i]
+	}
+	for _, rule := range r.apps[app+"-"+space] {
+		message = rule.apply(message)
+	}
+	return message
+}
+
+// redactAll masks secrets in a message that can't be attributed to an app,
+// such as one that couldn't be parsed, so every app's rules are applied.
+func (r *Redactor) redactAll(message string) string {
+	message = r.Redact("", "", message)
+	if r == nil {
+		return message
+	}
+	for _, rules := range r.apps {
+		for _, rule := range rules {
+			message = rule.apply(message)
+		}
+	}
+	return message
+}
@@ -1,7 +1,6 @@
 package shuttle
 
 import (
-	"encoding/json"
 	kafka "github.com/confluentinc/confluent-kafka-go/kafka"
 	"log"
 	"github.com/akkeris/logshuttle/events"
@@ -50,6 +49,7 @@ type Session struct {
 	space    string
 	site     string
 	group    string
+	Redactor *Redactor
 }
 
 func WriteAndFlush(log string, res http.ResponseWriter) error {
@@ -62,88 +62,72 @@ func WriteAndFlush(log string, res http.ResponseWriter) error {
 	return nil
 }
 
-func (ls *Session) RespondWithAppLog(e *kafka.Message) error {
-	var msg events.LogSpec
-	if err := json.Unmarshal(e.Value, &msg); err == nil {
-		if IsAppMatch(msg.Kubernetes.ContainerName, ls.app) && msg.Topic == ls.space {
-			ls.loops = 0
-			proc := ContainerToProc(msg.Kubernetes.ContainerName)
-			log := msg.Time.UTC().Format(time.RFC3339) + " " + ls.app + "-" + ls.space + " app[" + proc.Type + "." + strings.Replace(strings.Replace(msg.Kubernetes.PodName, "-"+proc.Type+"-", "", 1), proc.App+"-", "", 1) + "]: " + strings.TrimSpace(KubernetesToHumanReadable(msg.Log)) + "\n"
-			if err = WriteAndFlush(log, ls.response); err != nil {
-				return err
-			}
-		}
+// RespondWithLog parses the message with its source's parser and writes it
+// out if it belongs to the session's app or site.
+func (ls *Session) RespondWithLog(reg *ParserRegistration, e *kafka.Message) error {
+	msg, err := reg.Parser(e.Value)
+	if err != nil {
+		return nil
 	}
-	return nil
-}
-
-func (ls *Session) RespondWithIstioWebLog(e *kafka.Message) error {
-	var msg events.LogSpec
-	if ParseIstioWebLogMessage(e.Value, &msg) == false && ((IsAppMatch(msg.Kubernetes.ContainerName, ls.app) && msg.Topic == ls.space) || (msg.Site != "" && msg.Site == ls.site)) {
-		ls.loops = 0
-		if msg.Site == "" {
-			log := msg.Time.UTC().Format(time.RFC3339) + " " + ls.app + "-" + ls.space + " akkeris/router: " + msg.Log + " host=" + msg.Kubernetes.ContainerName + " path=" + msg.Path + "\n"
-			if err := WriteAndFlush(log, ls.response); err != nil {
-				return err
-			}
-		} else {
-			log := msg.Time.UTC().Format(time.RFC3339) + " " + msg.Site + " akkeris/router: " + msg.Log + " host=" + msg.Site + " path=" + msg.SitePath + "\n"
-			if err := WriteAndFlush(log, ls.response); err != nil {
-				return err
-			}
-		}
+	if reg.Kind == RouterLog || reg.Kind == BuildLog {
+		msg.Time = EventTime(msg.Time, e.Timestamp)
 	}
-	return nil
-}
-
-func (ls *Session) RespondWithIstioWebLogFromEnvoyAls(e *kafka.Message) error {
-	var msg events.LogSpec
-	if ParseIstioFromEnvoyWebLogMessage(e.Value, &msg) == false && ((IsAppMatch(msg.Kubernetes.ContainerName, ls.app) && msg.Topic == ls.space) || (msg.Site != "" && msg.Site == ls.site)) {
-		ls.loops = 0
+	var isApp = IsAppMatch(msg.Kubernetes.ContainerName, ls.app) && msg.Topic == ls.space
+	msg.Log = ls.Redactor.Redact(msg.Kubernetes.ContainerName, msg.Topic, msg.Log)
+	var log = ""
+	switch reg.Kind {
+	case RouterLog:
+		if !isApp && (msg.Site == "" || msg.Site != ls.site) {
+			return nil
+		}
 		if msg.Site == "" {
-			log := msg.Time.UTC().Format(time.RFC3339) + " " + ls.app + "-" + ls.space + " akkeris/router: " + msg.Log + " host=" + msg.Kubernetes.ContainerName + " path=" + msg.Path + "\n"
-			if err := WriteAndFlush(log, ls.response); err != nil {
-				return err
-			}
+			log = msg.Time.UTC().Format(time.RFC3339) + " " + ls.app + "-" + ls.space + " akkeris/router: " + msg.Log + " host=" + msg.Kubernetes.ContainerName + " path=" + msg.Path + "\n"
 		} else {
-			log := msg.Time.UTC().Format(time.RFC3339) + " " + msg.Site + " akkeris/router: " + msg.Log + " host=" + msg.Site + " path=" + msg.SitePath + "\n"
-			if err := WriteAndFlush(log, ls.response); err != nil {
-				return err
-			}
+			log = msg.Time.UTC().Format(time.RFC3339) + " " + msg.Site + " akkeris/router: " + msg.Log + " host=" + msg.Site + " path=" + msg.SitePath + "\n"
+		}
+	case BuildLog:
+		if !isApp {
+			return nil
+		}
+		log = msg.Time.UTC().Format(time.RFC3339) + " " + ls.app + "-" + ls.space + " akkeris/build: " + msg.Log + "\n"
+	default:
+		if !isApp {
+			return nil
+		}
+		text, _ := AppLogMessage(msg)
+		proc := ContainerToProc(msg.Kubernetes.ContainerName)
+		tag := "app[" + proc.Type + "." + strings.Replace(strings.Replace(msg.Kubernetes.PodName, "-"+proc.Type+"-", "", 1), proc.App+"-", "", 1) + "]"
+		if strings.HasPrefix(msg.Kubernetes.PodName, "akkeris/") {
+			tag = msg.Kubernetes.PodName
 		}
+		log = msg.Time.UTC().Format(time.RFC3339) + " " + ls.app + "-" + ls.space + " " + tag + ": " + strings.TrimSpace(text) + "\n"
 	}
-	return nil
+	ls.loops = 0
+	return WriteAndFlush(log, ls.response)
 }
 
-func (ls *Session) RespondWithWebLog(e *kafka.Message) error {
-	var msg events.LogSpec
-	if ParseWebLogMessage(e.Value, &msg) == false && ((IsAppMatch(msg.Kubernetes.ContainerName, ls.app) && msg.Topic == ls.space) || (msg.Site != "" && msg.Site == ls.site)) {
-		ls.loops = 0
-		if msg.Site == "" {
-			log := msg.Time.UTC().Format(time.RFC3339) + " " + ls.app + "-" + ls.space + " akkeris/router: " + msg.Log + " host=" + msg.Kubernetes.ContainerName + " path=" + msg.Path + "\n"
-			if err := WriteAndFlush(log, ls.response); err != nil {
-				return err
-			}
-		} else {
-			log := msg.Time.UTC().Format(time.RFC3339) + " " + msg.Site + " akkeris/router: " + msg.Log + " host=" + msg.Site + " path=" + msg.SitePath + "\n"
-			if err := WriteAndFlush(log, ls.response); err != nil {
-				return err
+// subscription returns the topics this session needs, app log patterns (such
+// as the default of every space) are narrowed to just the session's space.
+func (ls *Session) subscription(parsers *ParserRegistry) []string {
+	var subscription = make([]string, 0)
+	var seen = make(map[string]bool)
+	for _, reg := range parsers.Registrations() {
+		var topic = reg.Subscription()
+		if ls.site != "" && reg.Kind != RouterLog {
+			continue
+		}
+		if reg.Kind == AppLog && reg.IsPattern() {
+			if ls.space == "" || parsers.Lookup(ls.space) != reg {
+				continue
 			}
+			topic = ls.space
 		}
-	}
-	return nil
-}
-
-func (ls *Session) RespondWithBuildLog(e *kafka.Message) error {
-	var msg events.LogSpec
-	if ParseBuildLogMessage(e.Value, &msg) == false && IsAppMatch(msg.Kubernetes.ContainerName, ls.app) && msg.Topic == ls.space {
-		ls.loops = 0
-		log := msg.Time.UTC().Format(time.RFC3339) + " " + ls.app + "-" + ls.space + " akkeris/build: " + msg.Log + "\n"
-		if err := WriteAndFlush(log, ls.response); err != nil {
-			return err
+		if !seen[topic] {
+			seen[topic] = true
+			subscription = append(subscription, topic)
 		}
 	}
-	return nil
+	return subscription
 }
 
 func (ls *Session) ConsumeAndRespond(kafkaAddrs []string, app string, space string, site string, req *http.Request, res http.ResponseWriter) {
@@ -167,20 +151,13 @@ func (ls *Session) ConsumeAndRespond(kafkaAddrs []string, app string, space stri
 		debug = true
 	}
 
-	useEnvoyAls := false
-	if os.Getenv("RUN_ISTIO_ALS") == "true" {
-		useEnvoyAls = true
-	}
-
+	parsers := DefaultParsers()
 	consumer := events.CreateConsumerCluster(kafkaAddrs, ls.group)
-	if ls.site == "" && ls.space != "" {
-		consumer.SubscribeTopics([]string{ls.space, "alamoweblogs", "istio-access-logs", "alamobuildlogs"}, nil)
-	} else if ls.site != "" {
-		consumer.SubscribeTopics([]string{"alamoweblogs", "istio-access-logs"}, nil)
-	} else {
+	if ls.site == "" && ls.space == "" {
 		consumer.Close()
 		return
 	}
+	consumer.SubscribeTopics(ls.subscription(parsers), nil)
 	log.Printf("[info] listening for logs on %s[group: %s]\n", subject, ls.group)
 	defer consumer.Close()
 
@@ -209,46 +186,16 @@ func (ls *Session) ConsumeAndRespond(kafkaAddrs []string, app string, space stri
 		}
 		switch e := ev.(type) {
 		case *kafka.Message:
-			if ls.space != "" && *e.TopicPartition.Topic == ls.space {
-				if err := ls.RespondWithAppLog(e); err != nil {
-					if debug {
-						log.Printf("[debug] write and flush failed in app logs [%s] %s[group: %s]\n", err.Error(), subject, ls.group)
-					}
-					ls.IsOpen = false
-					break
-				}
-			} else if *e.TopicPartition.Topic == "alamoweblogs" {
-				if err := ls.RespondWithWebLog(e); err != nil {
-					if debug {
-						log.Printf("[debug] write and flush failed in f5 web logs [%s] %s[group: %s]\n", err.Error(), subject, ls.group)
-					}
-					ls.IsOpen = false
-					break
-				}
-			} else if !useEnvoyAls && *e.TopicPartition.Topic == "istio-access-logs" {
-				if err := ls.RespondWithIstioWebLog(e); err != nil {
-					if debug {
-						log.Printf("[debug] write and flush failed in istio app logs [%s] %s[group: %s]\n", err.Error(), subject, ls.group)
-					}
-					ls.IsOpen = false
-					break
-				}
-			} else if useEnvoyAls && *e.TopicPartition.Topic == "istio-access-logs" {
-				if err := ls.RespondWithIstioWebLogFromEnvoyAls(e); err != nil {
-					if debug {
-						log.Printf("[debug] write and flush failed in istio app logs [%s] %s[group: %s]\n", err.Error(), subject, ls.group)
-					}
-					ls.IsOpen = false
-					break
-				}
-			} else if ls.space != "" && *e.TopicPartition.Topic == "alamobuildlogs" {
-				if err := ls.RespondWithBuildLog(e); err != nil {
-					if debug {
-						log.Printf("[debug] write and flush failed in build logs [%s] %s[group: %s]\n", err.Error(), subject, ls.group)
-					}
-					ls.IsOpen = false
-					break
+			reg := parsers.Lookup(*e.TopicPartition.Topic)
+			if reg == nil || (ls.space == "" && reg.Kind != RouterLog) {
+				continue
+			}
+			if err := ls.RespondWithLog(reg, e); err != nil {
+				if debug {
+					log.Printf("[debug] write and flush failed in %s logs [%s] %s[group: %s]\n", *e.TopicPartition.Topic, err.Error(), subject, ls.group)
 				}
+				ls.IsOpen = false
+				break
 			}
 		case kafka.Error:
 			log.Printf("%% Error: %v\n", e)
@@ -1,24 +1,40 @@
 package shuttle
 
 import (
-	"encoding/json"
+	kafka "github.com/confluentinc/confluent-kafka-go/kafka"
 	"log"
 	"github.com/akkeris/logshuttle/drains"
 	"github.com/akkeris/logshuttle/events"
 	"github.com/akkeris/logshuttle/storage"
 	"github.com/akkeris/logshuttle/syslog"
+	"github.com/akkeris/logshuttle/urls"
+	"reflect"
 	"runtime"
 	"strings"
 	"sync"
-	"os"
+	"time"
 )
 
 // TODO: Connect on demand (but deal with bad hosts will be tricky)
 // TODO: Mark in storage errors connecting to syslog or drains
 
 type Destination struct {
-	route storage.Route
-	drain drains.Drain
+	route  storage.Route
+	drain  drains.Drain
+	filter *routeFilter
+}
+
+// The amount of recent undecodable messages kept for sampling.
+const maxFailedMessages = 100
+
+// A FailedMessage is a kafka message the shuttle was unable to parse.
+type FailedMessage struct {
+	Topic     string    `json:"topic"`
+	Partition int32     `json:"partition"`
+	Offset    int64     `json:"offset"`
+	Error     string    `json:"error"`
+	Value     string    `json:"value"`
+	Received  time.Time `json:"received"`
 }
 
 type Shuttle struct {
@@ -26,13 +42,21 @@ type Shuttle struct {
 	received      int
 	failed_decode int
 	test_mode     bool
-	routes        map[string][]Destination
-	route_keys    []string
+	routes        map[storage.RouteKey][]Destination
 	routes_mutex  *sync.Mutex
 	kafka_group   string
 	kafka_addrs   string
 	consumer      events.LogConsumer
 	client        *storage.Storage
+	Parsers       *ParserRegistry
+	dead_letters  string
+	producer      *events.LogProducer
+	failed        []FailedMessage
+	failed_mutex  *sync.Mutex
+	redactor      *Redactor
+	expired       func(storage.Route)
+	changes       map[string][]storage.RouteChange
+	changes_mutex *sync.Mutex
 }
 
 func (sh *Shuttle) PrintMetrics() {
@@ -44,102 +68,135 @@ func (sh *Shuttle) PrintMetrics() {
 
 func (sh *Shuttle) Refresh() {
 	sh.RefreshRoutes()
+	sh.RefreshRedactions()
 	sh.RefreshTopics()
 }
 
+// RefreshRedactions reloads the custom redaction rules from storage, the
+// previous rules are kept if storage is unavailable.
+func (sh *Shuttle) RefreshRedactions() {
+	redactor, err := LoadRedactor(sh.client)
+	if err != nil {
+		log.Printf("[shuttle] Unable to refresh redaction rules: %s\n", err)
+		return
+	}
+	sh.routes_mutex.Lock()
+	sh.redactor = redactor
+	sh.routes_mutex.Unlock()
+}
+
 func (sh *Shuttle) RefreshTopics() {
 	sh.consumer.Refresh()
 }
 
-func (sh *Shuttle) forwardAppLogs() {
-	for e := range sh.consumer.AppLogs {
-		var msg events.LogSpec
-		sh.received++
-		if err := json.Unmarshal(e.Value, &msg); err != nil {
-			sh.failed_decode++
+// forwardLogs dispatches messages to a worker per parser registration, so a
+// slow or busy source doesn't hold up the others.
+func (sh *Shuttle) forwardLogs() {
+	var workers = make(map[*ParserRegistration]chan *kafka.Message)
+	for _, reg := range sh.Parsers.Registrations() {
+		workers[reg] = make(chan *kafka.Message)
+		go sh.forwardParsedLogs(reg, workers[reg])
+	}
+	for e := range sh.consumer.Messages {
+		reg := sh.Parsers.Lookup(*e.TopicPartition.Topic)
+		if reg == nil {
+			continue
+		}
+		if worker, ok := workers[reg]; ok {
+			worker <- e
 		} else {
-			sh.SendMessage(msg)
+			sh.forwardParsedLog(reg, e)
 		}
 	}
 }
 
-func (sh *Shuttle) forwardIstioWebLogs() {
-	for e := range sh.consumer.IstioWebLogs {
-		var msg events.LogSpec
-		sh.received++
-		if err := ParseIstioWebLogMessage(e.Value, &msg); err == true {
-			sh.failed_decode++
-		} else {
-			var orgLog = msg.Log
-			msg.Log = msg.Log + " host=" + msg.Kubernetes.ContainerName + "-" + msg.Topic + " path=" + msg.Path
-			sh.SendMessage(msg)
-			if msg.Site != "" {
-				msg.Log = orgLog + " host=" + msg.Site + " path=" + msg.SitePath
-				msg.Kubernetes.PodName = "akkeris/router"
-				msg.Kubernetes.ContainerName = msg.Site
-				msg.Topic = ""
-				sh.SendMessage(msg)
-			}
-		}
+func (sh *Shuttle) forwardParsedLogs(reg *ParserRegistration, messages chan *kafka.Message) {
+	for e := range messages {
+		sh.forwardParsedLog(reg, e)
 	}
 }
 
-
-func (sh *Shuttle) forwardIstioWebLogsFromEnvoyAls(debug bool) {
-	for e := range sh.consumer.IstioWebLogs {
-		var msg events.LogSpec
-		sh.received++
-		if err := ParseIstioFromEnvoyWebLogMessage(e.Value, &msg); err == true {
-			if debug == true {
-				log.Printf("Unable to decode message from kafka: %s\n", e.Value);
-			}
-			sh.failed_decode++
-		} else {
-			var orgLog = msg.Log
-			msg.Log = msg.Log + " host=" + msg.Kubernetes.ContainerName + "-" + msg.Topic + " path=" + msg.Path
+func (sh *Shuttle) forwardParsedLog(reg *ParserRegistration, e *kafka.Message) {
+	sh.received++
+	msg, err := reg.Parser(e.Value)
+	if err != nil {
+		sh.failed_decode++
+		sh.recordFailure(e, err)
+		return
+	}
+	if reg.Kind == RouterLog || reg.Kind == BuildLog {
+		msg.Time = EventTime(msg.Time, e.Timestamp)
+	}
+	sh.routes_mutex.Lock()
+	redactor := sh.redactor
+	sh.routes_mutex.Unlock()
+	msg.Log = redactor.Redact(msg.Kubernetes.ContainerName, msg.Topic, msg.Log)
+	if reg.Kind == RouterLog {
+		var orgLog = msg.Log
+		msg.Log = msg.Log + " host=" + msg.Kubernetes.ContainerName + "-" + msg.Topic + " path=" + msg.Path
+		sh.SendMessage(msg)
+		if msg.Site != "" {
+			msg.Log = orgLog + " host=" + msg.Site + " path=" + msg.SitePath
+			msg.Kubernetes.PodName = "akkeris/router"
+			msg.Kubernetes.ContainerName = msg.Site
+			msg.Topic = ""
 			sh.SendMessage(msg)
-			if msg.Site != "" {
-				msg.Log = orgLog + " host=" + msg.Site + " path=" + msg.SitePath
-				msg.Kubernetes.PodName = "akkeris/router"
-				msg.Kubernetes.ContainerName = msg.Site
-				msg.Topic = ""
-				sh.SendMessage(msg)
-			}
 		}
+	} else {
+		sh.SendMessage(msg)
 	}
 }
 
-func (sh *Shuttle) forwardWebLogs() {
-	for e := range sh.consumer.WebLogs {
-		var msg events.LogSpec
-		sh.received++
-		if err := ParseWebLogMessage(e.Value, &msg); err == true {
-			sh.failed_decode++
-		} else {
-			var orgLog = msg.Log
-			msg.Log = msg.Log + " host=" + msg.Kubernetes.ContainerName + "-" + msg.Topic + " path=" + msg.Path
-			sh.SendMessage(msg)
-			if msg.Site != "" {
-				msg.Log = orgLog + " host=" + msg.Site + " path=" + msg.SitePath
-				msg.Kubernetes.PodName = "akkeris/router"
-				msg.Kubernetes.ContainerName = msg.Site
-				msg.Topic = ""
-				sh.SendMessage(msg)
-			}
+// recordFailure keeps a sample of the message, with secrets redacted, and if
+// enabled republishes it to the dead letter topic.
+func (sh *Shuttle) recordFailure(e *kafka.Message, parseErr error) {
+	var topic = ""
+	if e.TopicPartition.Topic != nil {
+		topic = *e.TopicPartition.Topic
+	}
+	// the app isn't known, so every app's redaction rules are applied.
+	sh.routes_mutex.Lock()
+	value := sh.redactor.redactAll(string(e.Value))
+	sh.routes_mutex.Unlock()
+	sh.failed_mutex.Lock()
+	sh.failed = append(sh.failed, FailedMessage{Topic: topic, Partition: e.TopicPartition.Partition, Offset: int64(e.TopicPartition.Offset), Error: parseErr.Error(), Value: value, Received: time.Now()})
+	if len(sh.failed) > maxFailedMessages {
+		sh.failed = sh.failed[len(sh.failed)-maxFailedMessages:]
+	}
+	sh.failed_mutex.Unlock()
+	if sh.producer != nil && sh.dead_letters != "" {
+		if err := sh.producer.AddDeadLetter(sh.dead_letters, e, parseErr); err != nil {
+			log.Printf("[shuttle] Unable to send message to dead letter topic %s: %s\n", sh.dead_letters, err)
 		}
 	}
 }
 
-func (sh *Shuttle) forwardBuildLogs() {
-	for e := range sh.consumer.BuildLogs {
-		var msg events.LogSpec
-		sh.received++
-		if err := ParseBuildLogMessage(e.Value, &msg); err == true {
-			sh.failed_decode++
-		} else {
-			sh.SendMessage(msg)
-		}
+// FailedMessages returns up to limit of the most recent undecodable messages,
+// newest first.
+func (sh *Shuttle) FailedMessages(limit int) []FailedMessage {
+	sh.failed_mutex.Lock()
+	defer sh.failed_mutex.Unlock()
+	var failed = make([]FailedMessage, 0)
+	for i := len(sh.failed) - 1; i >= 0 && len(failed) < limit; i-- {
+		failed = append(failed, sh.failed[i])
+	}
+	return failed
+}
+
+// EnableDeadLetters republishes messages that can't be parsed to the topic.
+func (sh *Shuttle) EnableDeadLetters(producer *events.LogProducer, topic string) {
+	if sh.Parsers.Lookup(topic) != nil {
+		log.Printf("[shuttle] Not enabling dead letter topic %s, it would be consumed as a log source.\n", topic)
+		return
 	}
+	sh.producer = producer
+	sh.dead_letters = topic
+}
+
+// OnRouteExpired is called with each route the shuttle removes from storage
+// because it expired, set it before Init as routes are refreshed by Init.
+func (sh *Shuttle) OnRouteExpired(fn func(storage.Route)) {
+	sh.expired = fn
 }
 
 func (sh *Shuttle) Init(client *storage.Storage, kafkaAddrs []string, kafkaGroup string) error {
@@ -150,31 +207,25 @@ func (sh *Shuttle) Init(client *storage.Storage, kafkaAddrs []string, kafkaGroup
 	sh.test_mode = false
 	sh.client = client
 	sh.routes_mutex = &sync.Mutex{}
+	sh.changes_mutex = &sync.Mutex{}
+	sh.changes = make(map[string][]storage.RouteChange)
+	sh.failed_mutex = &sync.Mutex{}
+	sh.failed = make([]FailedMessage, 0)
 	sh.routes_mutex.Lock()
-	sh.routes = make(map[string][]Destination)
-	sh.route_keys = make([]string, 0)
+	sh.routes = make(map[storage.RouteKey][]Destination)
 	sh.routes_mutex.Unlock()
 	sh.RefreshRoutes()
+	sh.watchRoutes()
+	sh.RefreshRedactions()
+	if sh.Parsers == nil {
+		sh.Parsers = DefaultParsers()
+	}
+	sh.Parsers.start()
+	sh.consumer.Subscription = sh.Parsers.Subscription()
 	sh.consumer.Init(kafkaAddrs, kafkaGroup)
 
-	// Start listening to app logs
-	go sh.forwardAppLogs()
-
-	// Start listening to web logs
-	go sh.forwardWebLogs()
-
-	// Start listening to istio web logs
-	if os.Getenv("RUN_ISTIO_ALS") == "true" {
-		istioAlsDebug := false 
-		if os.Getenv("RUN_ISTIO_ALS_DEBUG") == "true" {
-			istioAlsDebug = true
-		}
-		go sh.forwardIstioWebLogsFromEnvoyAls(istioAlsDebug)
-	} else {
-		go sh.forwardIstioWebLogs()
-	}
-	// Start listening to build logs
-	go sh.forwardBuildLogs()
+	// Start listening to every registered log source
+	go sh.forwardLogs()
 	return nil
 }
 
@@ -186,10 +237,36 @@ func (sh *Shuttle) SendMessage(message events.LogSpec) {
 		proc = events.Process{App: components[0], Type: components[1]}
 	}
 
+	// Messages without a topic are site router logs, the container is the site.
+	var r []Destination
 	sh.routes_mutex.Lock()
-	r := sh.routes[proc.App+message.Topic]
+	if message.Topic == "" {
+		r = sh.routes[storage.SiteRouteKey(message.Kubernetes.ContainerName)]
+	} else {
+		r = sh.routes[storage.AppRouteKey(proc.App, message.Topic)]
+		if len(sh.routes[storage.SpaceRouteKey(message.Topic)]) > 0 {
+			r = append(append([]Destination{}, r...), sh.routes[storage.SpaceRouteKey(message.Topic)]...)
+		}
+	}
 	sh.routes_mutex.Unlock()
+	if len(r) == 0 {
+		return
+	}
+	text, event := AppLogMessage(message)
+	var severity = syslog.SevInfo
+	if message.Stream == "stderr" || (event != nil && event.IsError()) {
+		severity = syslog.SevErr
+	}
+	var source = LogSource(message)
+	var now = time.Now()
 	for _, d := range r {
+		// expired routes are removed on the next refresh, until then skip them.
+		if d.route.Expired(now) {
+			continue
+		}
+		if !d.filter.allows(source, proc.Type, severity, text) {
+			continue
+		}
 		tag := proc.Type + "." + strings.Replace(strings.Replace(message.Kubernetes.PodName, "-"+proc.Type+"-", "", 1), proc.App+"-", "", 1)
 		if strings.HasPrefix(message.Kubernetes.PodName, "akkeris/") {
 			tag = message.Kubernetes.PodName
@@ -201,17 +278,13 @@ func (sh *Shuttle) SendMessage(message events.LogSpec) {
 		if sh.test_mode {
 			host = "logshuttle-test"
 		}
-		var severity = syslog.SevInfo
-		if message.Stream == "stderr" {
-			severity = syslog.SevErr
-		}
 		var p = syslog.Packet{
 			Severity: severity,
 			Facility: syslog.LogUser,
 			Hostname: host,
 			Tag:      tag,
 			Time:     message.Time,
-			Message:  KubernetesToHumanReadable(message.Log),
+			Message:  text,
 		}
 		d.drain.Packets() <- p
 		sh.sent++
@@ -235,53 +308,24 @@ func (sh *Shuttle) RefreshRoutes() {
 
 	// Add new routes not found.
 	wg := new(sync.WaitGroup)
+	var found = make(map[string]bool)
+	var now = time.Now()
 	for _, rt := range routesPkg {
-		var found = false
-		var route_key = rt.GetRouteKey()
-		sh.routes_mutex.Lock()
-		if sh.routes[route_key] != nil {
-			for _, extr := range sh.routes[route_key] {
-				if extr.route.Id == rt.Id {
-					found = true
-				}
-			}
+		if rt.Expired(now) {
+			sh.expireRoute(rt)
+			continue
 		}
-		sh.routes_mutex.Unlock()
-		// Explicitly disallow the test case url.
-		if found == false && rt.DestinationUrl != "syslog+tls://logs.apps.com:40841" {
+		found[rt.Id] = true
+		if existing, ok := sh.findRoute(rt.Id); !ok {
+			wg.Add(1)
+			go func(rts storage.Route) {
+				sh.addRoute(rts)
+				wg.Done()
+			}(rt)
+		} else if routeChanged(existing, rt) {
 			wg.Add(1)
 			go func(rts storage.Route) {
-				var duplicate = false
-				var rts_route_key = rts.GetRouteKey()
-				sh.routes_mutex.Lock()
-				for _, sr := range sh.routes[rts_route_key] {
-					if sr.drain.Url() == rts.DestinationUrl {
-						duplicate = true
-					}
-				}
-				sh.routes_mutex.Unlock()
-				if duplicate == false {
-					d, err := drains.Dial(rts.Id, rts.DestinationUrl)
-					if err == nil {
-						sh.routes_mutex.Lock()
-						sh.routes[rts_route_key] = append(sh.routes[rts_route_key], Destination{drain: d, route: rts})
-						var found_key = false
-						for _, v := range sh.route_keys {
-							if v == rts.GetRouteKey() {
-								found_key = true
-							}
-						}
-						if found_key == false {
-							sh.route_keys = append(sh.route_keys, rts_route_key)
-						}
-						sh.routes_mutex.Unlock()
-						log.Printf("[shuttle] Adding route: %s with key\n", rts.GetRouteString())
-					} else if err.Error() != "Host is part of a bad host list." {
-						log.Printf("[shuttle] Cannot add route: %s, (%s) will retry in 5 minutes\n", rts.GetRouteString(), err.Error())
-					}
-				} else {
-					log.Printf("[shuttle] Not adding duplicate route: %s\n", rts.GetRouteString())
-				}
+				sh.updateRoute(rts)
 				wg.Done()
 			}(rt)
 		}
@@ -289,31 +333,272 @@ func (sh *Shuttle) RefreshRoutes() {
 	wg.Wait()
 
 	// Remove routes no longer in storage
+	for _, id := range sh.routeIds() {
+		if found[id] == false {
+			sh.removeRoute(id)
+		}
+	}
+}
+
+// expireRoute removes an expired route from storage, it's only reported by the
+// shuttle that removed it, if another shuttle already has (or the storage is
+// read only) nothing is reported.
+func (sh *Shuttle) expireRoute(rt storage.Route) {
+	if err := (*sh.client).RemoveRoute(rt); err != nil {
+		if err != storage.ErrRouteNotFound && err != storage.ErrReadOnly {
+			log.Printf("[shuttle] Unable to remove expired route: %s (%s)\n", rt.GetRouteString(), err.Error())
+		}
+		return
+	}
+	log.Printf("[shuttle] Route expired: %s\n", rt.GetRouteString())
+	if sh.expired != nil {
+		sh.expired(rt)
+	}
+}
+
+// watchRoutes applies route changes as they happen if the storage supports
+// it, RefreshRoutes still polls in case a change is missed.
+func (sh *Shuttle) watchRoutes() {
+	watcher, ok := (*sh.client).(storage.RouteWatcher)
+	if !ok {
+		return
+	}
+	changes, err := watcher.WatchRoutes()
+	if err != nil {
+		log.Printf("[shuttle] Unable to watch for route changes, only polling: %s\n", err)
+		return
+	}
+	go func() {
+		for change := range changes {
+			sh.queueRouteChange(change)
+		}
+		log.Printf("[shuttle] Stopped watching for route changes, only polling\n")
+	}()
+}
+
+// queueRouteChange applies changes to each route in order on a goroutine per
+// route, so dialing a slow or unreachable drain doesn't hold up changes to
+// other routes. Reloads (which have no route id) are queued together.
+func (sh *Shuttle) queueRouteChange(change storage.RouteChange) {
+	var id = change.Route.Id
+	sh.changes_mutex.Lock()
+	defer sh.changes_mutex.Unlock()
+	if queue, ok := sh.changes[id]; ok {
+		sh.changes[id] = append(queue, change)
+		return
+	}
+	sh.changes[id] = []storage.RouteChange{change}
+	go sh.applyRouteChanges(id)
+}
+
+// applyRouteChanges applies the queued changes to a route until there are none.
+func (sh *Shuttle) applyRouteChanges(id string) {
+	for {
+		sh.changes_mutex.Lock()
+		queue := sh.changes[id]
+		if len(queue) == 0 {
+			delete(sh.changes, id)
+			sh.changes_mutex.Unlock()
+			return
+		}
+		change := queue[0]
+		sh.changes[id] = queue[1:]
+		sh.changes_mutex.Unlock()
+		sh.applyRouteChange(change)
+	}
+}
+
+func (sh *Shuttle) applyRouteChange(change storage.RouteChange) {
+	switch change.Type {
+	case storage.RouteAdded, storage.RouteUpdated:
+		// changes may only have the route's id, so read it from storage.
+		route, err := (*sh.client).GetRouteById(change.Route.Id)
+		if err != nil {
+			// it's been removed since, the removal follows.
+			return
+		}
+		if change.Type == storage.RouteAdded {
+			sh.addRoute(*route)
+		} else {
+			sh.updateRoute(*route)
+		}
+	case storage.RouteRemoved:
+		sh.removeRoute(change.Route.Id)
+	default:
+		sh.RefreshRoutes()
+	}
+}
+
+func (sh *Shuttle) findRoute(id string) (storage.Route, bool) {
+	sh.routes_mutex.Lock()
+	defer sh.routes_mutex.Unlock()
+	for _, destinations := range sh.routes {
+		for _, destination := range destinations {
+			if destination.route.Id == id {
+				return destination.route, true
+			}
+		}
+	}
+	return storage.Route{}, false
+}
+
+func (sh *Shuttle) hasRoute(id string) bool {
+	_, ok := sh.findRoute(id)
+	return ok
+}
+
+// routeChanged is true if a route was updated since it was added. Update
+// times are compared to the microsecond as postgres doesn't keep nanoseconds,
+// a route added from a change notice would otherwise differ once reloaded.
+func routeChanged(existing storage.Route, rt storage.Route) bool {
+	return existing.DestinationUrl != rt.DestinationUrl || !existing.Updated.Truncate(time.Microsecond).Equal(rt.Updated.Truncate(time.Microsecond)) || !reflect.DeepEqual(existing.Filters, rt.Filters)
+}
+
+func (sh *Shuttle) routeIds() []string {
+	var ids = make([]string, 0)
+	sh.routes_mutex.Lock()
+	for _, destinations := range sh.routes {
+		for _, destination := range destinations {
+			ids = append(ids, destination.route.Id)
+		}
+	}
+	sh.routes_mutex.Unlock()
+	return ids
+}
+
+// addRoute dials the route's drain and starts sending it logs, unless it's
+// already added.
+func (sh *Shuttle) addRoute(rts storage.Route) {
+	// Explicitly disallow the test case url.
+	if rts.DestinationUrl == "syslog+tls://logs.apps.com:40841" {
+		return
+	}
+	if rts.Expired(time.Now()) {
+		return
+	}
+	var duplicate = false
+	var rts_route_key = rts.GetRouteKey()
+	sh.routes_mutex.Lock()
+	for _, sr := range sh.routes[rts_route_key] {
+		if sr.route.Id == rts.Id {
+			sh.routes_mutex.Unlock()
+			return
+		}
+		if sr.drain.Url() == rts.DestinationUrl {
+			duplicate = true
+		}
+	}
+	sh.routes_mutex.Unlock()
+	filter, err := compileRouteFilter(rts.Filters)
+	if err != nil {
+		log.Printf("[shuttle] Cannot add route: %s, invalid filters (%s)\n", rts.GetRouteString(), err.Error())
+		return
+	} else if duplicate == true {
+		log.Printf("[shuttle] Not adding duplicate route: %s\n", rts.GetRouteString())
+		return
+	}
+	d, err := drains.Dial(rts.Id, rts.DestinationUrl)
+	if err != nil {
+		if err.Error() != "Host is part of a bad host list." {
+			log.Printf("[shuttle] Cannot add route: %s, (%s) will retry in 5 minutes\n", rts.GetRouteString(), err.Error())
+		}
+		return
+	}
 	sh.routes_mutex.Lock()
-	for _, route_key := range sh.route_keys {
-		if destinations, ok := sh.routes[route_key]; ok && len(destinations) > 0 {
-			for ndx, destination := range destinations {
-				var found = false
-				for _, rt := range routesPkg {
-					if rt.Id == destination.route.Id {
-						found = true
-					}
-				}
-				if found == false {
-					log.Printf("[shuttle] Removing route: %s\n", destination.route.GetRouteString())
-					err := drains.Undial(destination.drain.Id(), destination.drain.Url())
-					if len(destinations) == 1 {
-						sh.routes[route_key] = make([]Destination, 0)
-					} else {
-						sh.routes[route_key] = append(destinations[:ndx], destinations[ndx+1:]...)
-					}
-					if err != nil {
-						log.Printf("[shuttle] Unable to remove stale drains for %s and %s\n", destination.drain.Id(), destination.drain.Url())
-					}
-				}
+	// the route may have been added (e.g., by a notification) while dialing.
+	for _, sr := range sh.routes[rts_route_key] {
+		if sr.route.Id == rts.Id || sr.drain.Url() == rts.DestinationUrl {
+			sh.routes_mutex.Unlock()
+			drains.Undial(d.Id(), d.Url())
+			return
+		}
+	}
+	sh.routes[rts_route_key] = append(sh.routes[rts_route_key], Destination{drain: d, route: rts, filter: filter})
+	sh.routes_mutex.Unlock()
+	log.Printf("[shuttle] Adding route: %s with key\n", rts.GetRouteString())
+}
+
+// updateRoute changes the url or filters of an added route, a new url is only
+// switched to once its drain has dialed so no logs are lost. If it can't be
+// dialed logs continue to go to the old url.
+func (sh *Shuttle) updateRoute(rts storage.Route) {
+	existing, ok := sh.findRoute(rts.Id)
+	if !ok {
+		sh.addRoute(rts)
+		return
+	}
+	if !routeChanged(existing, rts) {
+		return
+	}
+	filter, err := compileRouteFilter(rts.Filters)
+	if err != nil {
+		log.Printf("[shuttle] Cannot update route: %s, invalid filters (%s)\n", rts.GetRouteString(), err.Error())
+		return
+	}
+	var d drains.Drain = nil
+	if existing.DestinationUrl != rts.DestinationUrl {
+		if rts.DestinationUrl == "syslog+tls://logs.apps.com:40841" {
+			return
+		}
+		if d, err = drains.Dial(rts.Id, rts.DestinationUrl); err != nil {
+			log.Printf("[shuttle] Cannot update route: %s, (%s) still sending to %s\n", rts.GetRouteString(), err.Error(), urls.Redact(existing.DestinationUrl))
+			return
+		}
+	}
+	var old drains.Drain = nil
+	var swapped = false
+	sh.routes_mutex.Lock()
+	var route_key = rts.GetRouteKey()
+	var destinations = sh.routes[route_key]
+	for ndx, destination := range destinations {
+		if destination.route.Id == rts.Id {
+			var updated = make([]Destination, len(destinations))
+			copy(updated, destinations)
+			updated[ndx].route = rts
+			updated[ndx].filter = filter
+			if d != nil {
+				old = destination.drain
+				updated[ndx].drain = d
 			}
+			sh.routes[route_key] = updated
+			swapped = true
+			break
 		}
 	}
 	sh.routes_mutex.Unlock()
+	if !swapped {
+		// the route was removed while dialing.
+		if d != nil {
+			drains.Undial(rts.Id, d.Url())
+		}
+		return
+	}
+	if old != nil {
+		if err := drains.Undial(rts.Id, old.Url()); err != nil {
+			log.Printf("[shuttle] Unable to remove stale drains for %s and %s\n", rts.Id, old.Url())
+		}
+	}
+	log.Printf("[shuttle] Updating route: %s\n", rts.GetRouteString())
+}
 
+// removeRoute stops sending logs to the route and closes its drain.
+func (sh *Shuttle) removeRoute(id string) {
+	sh.routes_mutex.Lock()
+	defer sh.routes_mutex.Unlock()
+	for route_key, destinations := range sh.routes {
+		for ndx, destination := range destinations {
+			if destination.route.Id != id {
+				continue
+			}
+			log.Printf("[shuttle] Removing route: %s\n", destination.route.GetRouteString())
+			// copy so a SendMessage holding the old slice isn't affected.
+			var remaining = make([]Destination, 0, len(destinations)-1)
+			remaining = append(remaining, destinations[:ndx]...)
+			sh.routes[route_key] = append(remaining, destinations[ndx+1:]...)
+			if err := drains.Undial(destination.drain.Id(), destination.drain.Url()); err != nil {
+				log.Printf("[shuttle] Unable to remove stale drains for %s and %s\n", destination.drain.Id(), destination.drain.Url())
+			}
+			return
+		}
+	}
 }
@@ -0,0 +1,111 @@
+package shuttle
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Where the time comes from when a router or build log doesn't have one,
+// configured with LOG_TIME_FALLBACK.
+const (
+	TimeFallbackReceived = "received" // when kafka received the message
+	TimeFallbackNow      = "now"      // when the shuttle processed the message
+)
+
+const defaultMaxTimeSkew = time.Minute * 10
+
+type timeConfig struct {
+	fallback string
+	maxSkew  time.Duration
+}
+
+var timeConfigOnce sync.Once
+var eventTimeConfig timeConfig
+
+func loadTimeConfig() timeConfig {
+	timeConfigOnce.Do(func() {
+		eventTimeConfig.fallback = TimeFallbackReceived
+		if fallback := os.Getenv("LOG_TIME_FALLBACK"); fallback != "" {
+			if fallback != TimeFallbackReceived && fallback != TimeFallbackNow {
+				log.Fatalf("Fatal: LOG_TIME_FALLBACK must be %s or %s, was %s\n", TimeFallbackReceived, TimeFallbackNow, fallback)
+			}
+			eventTimeConfig.fallback = fallback
+		}
+		eventTimeConfig.maxSkew = defaultMaxTimeSkew
+		if skew := os.Getenv("LOG_TIME_MAX_SKEW"); skew != "" {
+			d, err := time.ParseDuration(skew)
+			if err != nil || d < 0 {
+				log.Fatalf("Fatal: LOG_TIME_MAX_SKEW must be a duration (e.g., 10m), was %s\n", skew)
+			}
+			eventTimeConfig.maxSkew = d
+		}
+	})
+	return eventTimeConfig
+}
+
+// EventTime returns the time a log should be stamped with. The source's own
+// time is used when present, otherwise the fallback, and is clamped to within
+// the max skew of now (0 disables clamping) so a bad clock can't reorder logs.
+func EventTime(source time.Time, received time.Time) time.Time {
+	return eventTime(loadTimeConfig(), source, received, time.Now())
+}
+
+func eventTime(config timeConfig, source time.Time, received time.Time, now time.Time) time.Time {
+	if source.IsZero() {
+		if config.fallback == TimeFallbackReceived && !received.IsZero() {
+			source = received
+		} else {
+			return now
+		}
+	}
+	if config.maxSkew > 0 {
+		if source.Before(now.Add(-config.maxSkew)) {
+			return now.Add(-config.maxSkew)
+		} else if source.After(now.Add(config.maxSkew)) {
+			return now.Add(config.maxSkew)
+		}
+	}
+	return source
+}
+
+// Layouts web and build logs commonly use for their timestamps.
+var sourceTimeLayouts = []string{
+	time.RFC3339Nano,
+	"02/Jan/2006:15:04:05 -0700",
+	"2006-01-02 15:04:05.999999999 -0700",
+	"2006-01-02 15:04:05.999999999Z07:00",
+	"2006-01-02T15:04:05.999999999",
+	time.RFC1123Z,
+	time.RFC1123,
+}
+
+// ParseSourceTime parses a timestamp from a log source, either one of the
+// common layouts or unix epoch seconds, the zero time is returned if it can't.
+func ParseSourceTime(value string) time.Time {
+	value = strings.TrimSpace(value)
+	if value == "" || value == "-" {
+		return time.Time{}
+	}
+	for _, layout := range sourceTimeLayouts {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t
+		}
+	}
+	var parts = strings.SplitN(value, ".", 2)
+	seconds, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || seconds <= 0 {
+		return time.Time{}
+	}
+	var nanoseconds int64 = 0
+	if len(parts) == 2 {
+		var fraction = (parts[1] + "000000000")[0:9]
+		if nanoseconds, err = strconv.ParseInt(fraction, 10, 64); err != nil || nanoseconds < 0 {
+			return time.Time{}
+		}
+	}
+	return time.Unix(seconds, nanoseconds)
+}
@@ -0,0 +1,35 @@
+package shuttle
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+	"time"
+)
+
+func TestEventTime(t *testing.T) {
+	var now = time.Date(2020, 10, 10, 12, 0, 0, 0, time.UTC)
+	var config = timeConfig{fallback: TimeFallbackReceived, maxSkew: time.Minute * 10}
+	Convey("Ensure the source time is kept when within the max skew.", t, func() {
+		So(eventTime(config, now.Add(-time.Minute*5), now, now), ShouldResemble, now.Add(-time.Minute*5))
+	})
+	Convey("Ensure the source time is clamped to the max skew.", t, func() {
+		So(eventTime(config, now.Add(-time.Hour), now, now), ShouldResemble, now.Add(-time.Minute*10))
+		So(eventTime(config, now.Add(time.Hour), now, now), ShouldResemble, now.Add(time.Minute*10))
+		So(eventTime(timeConfig{fallback: TimeFallbackNow}, now.Add(-time.Hour), now, now), ShouldResemble, now.Add(-time.Hour))
+	})
+	Convey("Ensure the fallback is used when the source has no time.", t, func() {
+		So(eventTime(config, time.Time{}, now.Add(-time.Minute), now), ShouldResemble, now.Add(-time.Minute))
+		So(eventTime(config, time.Time{}, time.Time{}, now), ShouldResemble, now)
+		So(eventTime(timeConfig{fallback: TimeFallbackNow, maxSkew: time.Minute}, time.Time{}, now.Add(-time.Second), now), ShouldResemble, now)
+	})
+	Convey("Ensure web log timestamps are preserved.", t, func() {
+		msg, err := ParseWebLog([]byte(`hostname=app-space.example.com status=200 timestamp=2020-10-10T11:59:00.5Z`))
+		So(err, ShouldEqual, nil)
+		So(msg.Time.Equal(time.Date(2020, 10, 10, 11, 59, 0, 500000000, time.UTC)), ShouldEqual, true)
+		msg, err = ParseCombinedWebLog([]byte(`app-space.example.com 10.0.0.1 - - [10/Oct/2020:13:55:36 -0700] "GET / HTTP/1.1" 200 10`), true)
+		So(err, ShouldEqual, nil)
+		So(msg.Time.Equal(time.Date(2020, 10, 10, 20, 55, 36, 0, time.UTC)), ShouldEqual, true)
+		So(ParseSourceTime("1602331200.25").Equal(time.Date(2020, 10, 10, 12, 0, 0, 250000000, time.UTC)), ShouldEqual, true)
+		So(ParseSourceTime("-").IsZero(), ShouldEqual, true)
+	})
+}
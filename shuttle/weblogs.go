@@ -0,0 +1,291 @@
+package shuttle
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/akkeris/logshuttle/events"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Web log formats that can be configured per topic with KAFKA_WEB_LOG_FORMATS.
+const (
+	WebLogFormatLogfmt        = "logfmt"
+	WebLogFormatCommon        = "common"
+	WebLogFormatCombined      = "combined"
+	WebLogFormatVhostCombined = "vhost_combined"
+	WebLogFormatNginxJSON     = "nginx_json"
+)
+
+// WebLogParser returns the parser for a web log format.
+func WebLogParser(format string) (Parser, error) {
+	switch format {
+	case WebLogFormatLogfmt, "":
+		return ParseWebLog, nil
+	case WebLogFormatCommon, WebLogFormatCombined:
+		return func(data []byte) (events.LogSpec, error) { return ParseCombinedWebLog(data, false) }, nil
+	case WebLogFormatVhostCombined:
+		return func(data []byte) (events.LogSpec, error) { return ParseCombinedWebLog(data, true) }, nil
+	case WebLogFormatNginxJSON:
+		return ParseNginxJSONWebLog, nil
+	default:
+		return nil, fmt.Errorf("Unknown web log format %s", format)
+	}
+}
+
+// WebLogFormats reads KAFKA_WEB_LOG_FORMATS, a comma separated list of
+// topic:format pairs, e.g., "nginx-logs:combined,ingress-logs:nginx_json".
+func WebLogFormats() (map[string]string, error) {
+	var formats = make(map[string]string)
+	for _, entry := range strings.Split(os.Getenv("KAFKA_WEB_LOG_FORMATS"), ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		var parts = strings.SplitN(entry, ":", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("Invalid web log format %s, expected topic:format", entry)
+		}
+		if _, err := WebLogParser(parts[1]); err != nil {
+			return nil, err
+		}
+		formats[parts[0]] = parts[1]
+	}
+	return formats, nil
+}
+
+// splitCombined splits an NCSA log line into its fields, [bracketed] and
+// "quoted" fields are kept whole (without the brackets or quotes).
+func splitCombined(line string) ([]string, error) {
+	var fields = make([]string, 0, 12)
+	var i = 0
+	for i < len(line) {
+		for i < len(line) && isLogfmtSpace(line[i]) {
+			i++
+		}
+		if i == len(line) {
+			break
+		}
+		switch line[i] {
+		case '"':
+			var end = i + 1
+			for end < len(line) && line[end] != '"' {
+				if line[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(line) {
+				return nil, fmt.Errorf("unterminated quoted field at offset %d", i)
+			}
+			fields = append(fields, strings.Replace(strings.Replace(line[i+1:end], "\\\"", "\"", -1), "\\\\", "\\", -1))
+			i = end + 1
+		case '[':
+			var end = strings.IndexByte(line[i:], ']')
+			if end == -1 {
+				return nil, fmt.Errorf("unterminated bracketed field at offset %d", i)
+			}
+			fields = append(fields, line[i+1:i+end])
+			i = i + end + 1
+		default:
+			var start = i
+			for i < len(line) && !isLogfmtSpace(line[i]) {
+				i++
+			}
+			fields = append(fields, line[start:i])
+		}
+	}
+	return fields, nil
+}
+
+// splitRequest splits a request line ("GET /path HTTP/1.1") into its method,
+// path and protocol, the host is returned if the path is an absolute url.
+func splitRequest(request string) (method string, path string, protocol string, host string, err error) {
+	var parts = strings.Fields(request)
+	if len(parts) < 2 || len(parts) > 3 {
+		return "", "", "", "", fmt.Errorf("invalid request line %q", request)
+	}
+	method = parts[0]
+	path = parts[1]
+	if len(parts) == 3 {
+		protocol = parts[2]
+	}
+	if strings.HasPrefix(path, "http://") || strings.HasPrefix(path, "https://") {
+		if u, err := url.Parse(path); err == nil {
+			host = u.Host
+			path = u.RequestURI()
+		}
+	}
+	return method, path, protocol, host, nil
+}
+
+func stripPort(host string) string {
+	if i := strings.LastIndexByte(host, ':'); i != -1 && !strings.Contains(host[i:], "]") {
+		return host[:i]
+	}
+	return host
+}
+
+// ParseCombinedWebLog parses NCSA common or combined log lines (any fields
+// after the user agent, such as those nginx ingress adds, are ignored). With
+// vhost the line starts with the virtual host (apache's vhost_combined or
+// nginx's $host), otherwise the host must be in the request line.
+func ParseCombinedWebLog(data []byte, vhost bool) (events.LogSpec, error) {
+	fields, err := splitCombined(string(data))
+	if err != nil {
+		return events.LogSpec{}, err
+	}
+	var host = ""
+	if vhost {
+		if len(fields) == 0 {
+			return events.LogSpec{}, errors.New("missing virtual host")
+		}
+		host = stripPort(fields[0])
+		fields = fields[1:]
+	}
+	if len(fields) < 7 {
+		return events.LogSpec{}, fmt.Errorf("expected at least 7 fields but found %d", len(fields))
+	}
+	method, path, protocol, requestHost, err := splitRequest(fields[4])
+	if err != nil {
+		return events.LogSpec{}, err
+	}
+	if host == "" {
+		host = requestHost
+	}
+	if host == "" {
+		return events.LogSpec{}, errors.New("unable to determine host, use vhost_combined or absolute request urls")
+	}
+	var bytesSent = fields[6]
+	if bytesSent == "-" {
+		bytesSent = "0"
+	}
+	var pairs = []LogfmtPair{
+		{Key: "hostname", Value: host},
+		{Key: "method", Value: method},
+		{Key: "path", Value: path},
+	}
+	if protocol != "" {
+		pairs = append(pairs, LogfmtPair{Key: "protocol", Value: protocol})
+	}
+	pairs = append(pairs,
+		LogfmtPair{Key: "status", Value: fields[5]},
+		LogfmtPair{Key: "bytes", Value: bytesSent},
+		LogfmtPair{Key: "source", Value: fields[0]},
+		LogfmtPair{Key: "timestamp", Value: fields[3]})
+	if len(fields) >= 9 {
+		if fields[7] != "-" {
+			pairs = append(pairs, LogfmtPair{Key: "referer", Value: fields[7]})
+		}
+		if fields[8] != "-" {
+			pairs = append(pairs, LogfmtPair{Key: "user_agent", Value: fields[8]})
+		}
+	}
+	return WebLogFromPairs(pairs)
+}
+
+// The nginx variables that map to the fields a router log uses, in the order
+// they're preferred.
+var nginxJSONFields = []struct {
+	key   string
+	names []string
+}{
+	{"hostname", []string{"host", "http_host", "server_name", "hostname"}},
+	{"method", []string{"request_method", "method"}},
+	{"path", []string{"request_uri", "uri", "path"}},
+	{"protocol", []string{"server_protocol", "protocol"}},
+	{"status", []string{"status"}},
+	{"bytes", []string{"body_bytes_sent", "bytes_sent", "bytes"}},
+	{"source", []string{"http_x_forwarded_for", "remote_addr", "source"}},
+	{"request_id", []string{"request_id", "req_id"}},
+	{"total", []string{"request_time"}},
+	{"service", []string{"upstream_response_time"}},
+	{"referer", []string{"http_referer", "referer"}},
+	{"user_agent", []string{"http_user_agent", "user_agent"}},
+	{"timestamp", []string{"time_iso8601", "time_local", "timestamp", "time"}},
+}
+
+// secondsToMilliseconds converts nginx's seconds (e.g., 0.012) into the
+// router's milliseconds (e.g., 12.00ms), unparsable values are left alone.
+func secondsToMilliseconds(value string) string {
+	seconds, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return value
+	}
+	return fmt.Sprintf("%.2fms", seconds*1000)
+}
+
+// ParseNginxJSONWebLog parses a json object of nginx variables (log_format
+// escape=json), the host is taken from $host, $http_host or $server_name.
+func ParseNginxJSONWebLog(data []byte) (events.LogSpec, error) {
+	var values map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&values); err != nil {
+		return events.LogSpec{}, err
+	}
+	var strs = make(map[string]string)
+	for k, v := range values {
+		switch value := v.(type) {
+		case string:
+			strs[k] = value
+		case json.Number:
+			strs[k] = value.String()
+		case bool:
+			strs[k] = strconv.FormatBool(value)
+		case nil:
+			strs[k] = ""
+		default:
+			b, _ := json.Marshal(value)
+			strs[k] = string(b)
+		}
+	}
+	if _, ok := strs["request_uri"]; !ok {
+		if request, ok := strs["request"]; ok {
+			if method, path, protocol, host, err := splitRequest(request); err == nil {
+				strs["request_method"] = method
+				strs["request_uri"] = path
+				strs["server_protocol"] = protocol
+				if host != "" && strs["host"] == "" {
+					strs["host"] = host
+				}
+				delete(strs, "request")
+			}
+		}
+	}
+
+	var pairs = make([]LogfmtPair, 0, len(strs))
+	var used = make(map[string]bool)
+	for _, field := range nginxJSONFields {
+		for _, name := range field.names {
+			if value, ok := strs[name]; ok && value != "" && value != "-" {
+				if field.key == "hostname" {
+					value = stripPort(value)
+				} else if field.key == "total" || field.key == "service" {
+					value = secondsToMilliseconds(value)
+				}
+				pairs = append(pairs, LogfmtPair{Key: field.key, Value: value})
+				break
+			}
+		}
+		for _, name := range field.names {
+			used[name] = true
+		}
+	}
+	var others = make([]string, 0)
+	for k := range strs {
+		if !used[k] {
+			others = append(others, k)
+		}
+	}
+	sort.Strings(others)
+	for _, k := range others {
+		pairs = append(pairs, LogfmtPair{Key: k, Value: strs[k]})
+	}
+	return WebLogFromPairs(pairs)
+}
@@ -0,0 +1,40 @@
+package shuttle
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+)
+
+func TestWebLogFormats(t *testing.T) {
+	Convey("Ensure combined logs with a virtual host produce a router log.", t, func() {
+		parser, err := WebLogParser(WebLogFormatVhostCombined)
+		So(err, ShouldEqual, nil)
+		msg, err := parser([]byte(`app-space.example.com:443 10.0.0.1 - - [10/Oct/2020:13:55:36 -0700] "GET /some/path?a=b HTTP/1.1" 200 2326 "-" "curl/7.64.1 (x86_64)" 512 0.004 [space-app-80]`))
+		So(err, ShouldEqual, nil)
+		So(msg.Kubernetes.ContainerName, ShouldEqual, "app")
+		So(msg.Topic, ShouldEqual, "space")
+		So(msg.Path, ShouldEqual, "/some/path?a=b")
+		So(msg.Log, ShouldEqual, `method=GET protocol=HTTP/1.1 status=200 bytes=2326 fwd="10.0.0.1" user_agent="curl/7.64.1 (x86_64)"`)
+	})
+	Convey("Ensure common logs use the host from absolute request urls.", t, func() {
+		msg, err := ParseCombinedWebLog([]byte(`10.0.0.1 - frank [10/Oct/2020:13:55:36 -0700] "POST http://app-space.example.com/login HTTP/1.0" 302 -`), false)
+		So(err, ShouldEqual, nil)
+		So(msg.Kubernetes.ContainerName, ShouldEqual, "app")
+		So(msg.Path, ShouldEqual, "/login")
+		So(msg.Log, ShouldEqual, `method=POST protocol=HTTP/1.0 status=302 bytes=0 fwd="10.0.0.1"`)
+		_, err = ParseCombinedWebLog([]byte(`10.0.0.1 - - [10/Oct/2020:13:55:36 -0700] "GET / HTTP/1.1" 200 10`), false)
+		So(err, ShouldNotEqual, nil)
+	})
+	Convey("Ensure nginx json logs produce a router log.", t, func() {
+		msg, err := ParseNginxJSONWebLog([]byte(`{"host":"app-space.example.com","remote_addr":"10.0.0.1","http_x_forwarded_for":"-","request_method":"GET","request_uri":"/","status":404,"body_bytes_sent":"12","request_time":"0.012","request_id":"abc","upstream_addr":"10.1.1.1:80"}`))
+		So(err, ShouldEqual, nil)
+		So(msg.Kubernetes.ContainerName, ShouldEqual, "app")
+		So(msg.Topic, ShouldEqual, "space")
+		So(msg.Path, ShouldEqual, "/")
+		So(msg.Log, ShouldEqual, `method=GET status=404 bytes=12 fwd="10.0.0.1" request_id=abc total=12.00ms upstream_addr=10.1.1.1:80`)
+	})
+	Convey("Ensure unknown web log formats are rejected.", t, func() {
+		_, err := WebLogParser("clf2")
+		So(err, ShouldNotEqual, nil)
+	})
+}
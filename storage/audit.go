@@ -0,0 +1,276 @@
+package storage
+
+import (
+	"encoding/json"
+	"github.com/akkeris/logshuttle/urls"
+	"github.com/nu7hatch/gouuid"
+	"gopkg.in/redis.v4"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// RouteAudit records a change to a route, who made it and what the route was
+// before and after (nil if it was added or removed). Credentials in the urls
+// are redacted so the history can be shown to anyone who can see the drains.
+// ForwardedFor is the X-Forwarded-For header of the request as given, unlike
+// the caller it can be set to anything by the client.
+type RouteAudit struct {
+	Id           string    `json:"id"`
+	Drain        string    `json:"drain"`
+	Action       string    `json:"action"`
+	App          string    `json:"app,omitempty"`
+	Space        string    `json:"space,omitempty"`
+	Site         string    `json:"site,omitempty"`
+	Actor        string    `json:"actor"`
+	Caller       string    `json:"caller"`
+	ForwardedFor string    `json:"forwarded_for,omitempty"`
+	Before       *Route    `json:"before,omitempty"`
+	After        *Route    `json:"after,omitempty"`
+	Created      time.Time `json:"created"`
+}
+
+// RouteExpired is the action of an audit for a route that was removed by the
+// shuttle when it expired.
+const RouteExpired = "expired"
+
+// NewRouteAudit describes a change, the action is RouteAdded, RouteUpdated,
+// RouteRemoved or RouteExpired. The actor is who made the change and the
+// caller where the request came from.
+func NewRouteAudit(action string, actor string, caller string, before *Route, after *Route) (RouteAudit, error) {
+	id, err := uuid.NewV4()
+	if err != nil {
+		return RouteAudit{}, err
+	}
+	audit := RouteAudit{Id: id.String(), Action: action, Actor: actor, Caller: caller, Before: redactRoute(before), After: redactRoute(after), Created: time.Now()}
+	route := after
+	if route == nil {
+		route = before
+	}
+	if route != nil {
+		audit.Drain, audit.App, audit.Space, audit.Site = route.Id, route.App, route.Space, route.Site
+	}
+	return audit, nil
+}
+
+// How many changes are kept for each app, site or space, older changes are
+// removed as new ones are recorded.
+const defaultRouteAuditLimit = 1000
+
+var routeAuditLimitOnce sync.Once
+var routeAuditLimitValue int
+
+// routeAuditLimit is DRAIN_HISTORY_LIMIT or the default.
+func routeAuditLimit() int {
+	routeAuditLimitOnce.Do(func() {
+		routeAuditLimitValue = defaultRouteAuditLimit
+		if limit := os.Getenv("DRAIN_HISTORY_LIMIT"); limit != "" {
+			n, err := strconv.Atoi(limit)
+			if err != nil || n < 1 {
+				log.Fatalf("Fatal: DRAIN_HISTORY_LIMIT must be a number greater than 0, was %s\n", limit)
+			}
+			routeAuditLimitValue = n
+		}
+	})
+	return routeAuditLimitValue
+}
+
+func redactRoute(route *Route) *Route {
+	if route == nil {
+		return nil
+	}
+	redacted := *route
+	redacted.DestinationUrl = urls.Redact(route.DestinationUrl)
+	return &redacted
+}
+
+func (a *RouteAudit) GetRouteKey() RouteKey {
+	route := Route{App: a.App, Space: a.Space, Site: a.Site}
+	return route.GetRouteKey()
+}
+
+func marshalAuditRoute(route *Route) (string, error) {
+	if route == nil {
+		return "", nil
+	}
+	bytes, err := json.Marshal(route)
+	return string(bytes), err
+}
+
+func unmarshalAuditRoute(route string) (*Route, error) {
+	if route == "" {
+		return nil, nil
+	}
+	r, err := UnmarshalRoute(route)
+	return &r, err
+}
+
+// Postgres Interface
+
+func (rs *PostgresStorage) AddRouteAudit(audit RouteAudit) error {
+	return rs.addRouteAudit(audit, routeAuditLimit())
+}
+
+func (rs *PostgresStorage) addRouteAudit(audit RouteAudit, limit int) error {
+	before, err := marshalAuditRoute(audit.Before)
+	if err != nil {
+		return err
+	}
+	after, err := marshalAuditRoute(audit.After)
+	if err != nil {
+		return err
+	}
+	_, err = rs.client.Exec("insert into drain_audits (audit, drain, action, site, app, space, actor, caller, forwarded_for, before, after, created) values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)",
+		audit.Id, audit.Drain, audit.Action, audit.Site, audit.App, audit.Space, audit.Actor, audit.Caller, audit.ForwardedFor, before, after, audit.Created)
+	if err != nil {
+		return err
+	}
+	// the history is already recorded, trimming it can wait for the next change.
+	key := audit.GetRouteKey()
+	const trim = "delete from drain_audits where audit in (select audit from drain_audits "
+	switch key.Kind {
+	case RouteKindSite:
+		_, err = rs.client.Exec(trim+"where site=$1 order by created desc offset $2)", key.Site, limit)
+	case RouteKindSpace:
+		_, err = rs.client.Exec(trim+"where site='' and app='' and space=$1 order by created desc offset $2)", key.Space, limit)
+	default:
+		_, err = rs.client.Exec(trim+"where site='' and app=$1 and space=$2 order by created desc offset $3)", key.App, key.Space, limit)
+	}
+	if err != nil {
+		log.Printf("[storage] Unable to trim the drain history: %s\n", err)
+	}
+	return nil
+}
+
+func (rs *PostgresStorage) GetRouteAudits(key RouteKey) ([]RouteAudit, error) {
+	const query = "select audit, drain, action, site, app, space, actor, caller, forwarded_for, before, after, created from drain_audits "
+	switch key.Kind {
+	case RouteKindSite:
+		return rs.queryRouteAudits(query+"where site=$1 order by created desc", key.Site)
+	case RouteKindSpace:
+		return rs.queryRouteAudits(query+"where site='' and app='' and space=$1 order by created desc", key.Space)
+	default:
+		return rs.queryRouteAudits(query+"where site='' and app=$1 and space=$2 order by created desc", key.App, key.Space)
+	}
+}
+
+func (rs *PostgresStorage) queryRouteAudits(query string, args ...interface{}) ([]RouteAudit, error) {
+	rows, err := rs.client.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var audits []RouteAudit = make([]RouteAudit, 0)
+	for rows.Next() {
+		var audit RouteAudit
+		var before, after string
+		err = rows.Scan(&audit.Id, &audit.Drain, &audit.Action, &audit.Site, &audit.App, &audit.Space, &audit.Actor, &audit.Caller, &audit.ForwardedFor, &before, &after, &audit.Created)
+		if err != nil {
+			return nil, err
+		}
+		if audit.Before, err = unmarshalAuditRoute(before); err != nil {
+			return nil, err
+		}
+		if audit.After, err = unmarshalAuditRoute(after); err != nil {
+			return nil, err
+		}
+		audits = append(audits, audit)
+	}
+	return audits, rows.Err()
+}
+
+// Redis Interface
+
+// The changes to the routes of each app, site or space are kept newest first
+// in a list (a json blob per change) next to the route index, trimmed to the
+// limit as changes are added.
+func redisAuditKey(key RouteKey) string {
+	switch key.Kind {
+	case RouteKindSite:
+		return "{routes}:audits:site:" + key.Site
+	case RouteKindSpace:
+		return "{routes}:audits:space:" + key.Space
+	default:
+		return "{routes}:audits:app:" + key.App + ":" + key.Space
+	}
+}
+
+func (rs *RedisStorage) AddRouteAudit(audit RouteAudit) error {
+	return rs.addRouteAudit(audit, routeAuditLimit())
+}
+
+func (rs *RedisStorage) addRouteAudit(audit RouteAudit, limit int) error {
+	bytes, err := json.Marshal(audit)
+	if err != nil {
+		return err
+	}
+	key := redisAuditKey(audit.GetRouteKey())
+	return rs.client.Watch(func(tx *redis.Tx) error {
+		_, err := tx.MultiExec(func() error {
+			tx.LPush(key, string(bytes))
+			tx.LTrim(key, 0, int64(limit-1))
+			return nil
+		})
+		return err
+	}, key)
+}
+
+func (rs *RedisStorage) GetRouteAudits(key RouteKey) ([]RouteAudit, error) {
+	vals, err := rs.client.LRange(redisAuditKey(key), 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	var audits []RouteAudit = make([]RouteAudit, 0, len(vals))
+	for _, val := range vals {
+		var audit RouteAudit
+		if err = json.Unmarshal([]byte(val), &audit); err != nil {
+			return nil, err
+		}
+		audits = append(audits, audit)
+	}
+	return audits, nil
+}
+
+// Memory Interface
+
+func (ms *MemoryStorage) AddRouteAudit(audit RouteAudit) error {
+	return ms.addRouteAudit(audit, routeAuditLimit())
+}
+
+// addRouteAudit adds the change and removes the oldest changes of the same app,
+// site or space over the limit.
+func (ms *MemoryStorage) addRouteAudit(audit RouteAudit, limit int) error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	key := audit.GetRouteKey()
+	audits := append(ms.audits, audit)
+	count := 0
+	for _, a := range audits {
+		if a.GetRouteKey() == key {
+			count++
+		}
+	}
+	ms.audits = make([]RouteAudit, 0, len(audits))
+	for _, a := range audits {
+		if count > limit && a.GetRouteKey() == key {
+			count--
+			continue
+		}
+		ms.audits = append(ms.audits, a)
+	}
+	return ms.save()
+}
+
+func (ms *MemoryStorage) GetRouteAudits(key RouteKey) ([]RouteAudit, error) {
+	ms.mutex.RLock()
+	defer ms.mutex.RUnlock()
+	var audits []RouteAudit = make([]RouteAudit, 0)
+	for i := len(ms.audits) - 1; i >= 0; i-- {
+		if ms.audits[i].GetRouteKey() == key {
+			audits = append(audits, ms.audits[i])
+		}
+	}
+	return audits, nil
+}
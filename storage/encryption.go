@@ -0,0 +1,298 @@
+package storage
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// Encrypted drain urls are stored as enc:v1:{key id}:{data key}:{url}, the url
+// is encrypted with a random data key (AES-256-GCM) which is encrypted with the
+// key (also AES-256-GCM). Both are base64 encoded with their nonce prepended.
+const encryptedUrlPrefix = "enc:v1:"
+
+// DrainKeys encrypt drain urls at rest, new urls are encrypted with the primary
+// key and any of the keys can decrypt, so keys can be rotated.
+type DrainKeys struct {
+	primary string
+	keys    map[string][]byte
+}
+
+// ParseDrainKeys parses comma (or newline) separated id:key pairs, each key is
+// 32 bytes encoded in base64. The first key is the primary key.
+func ParseDrainKeys(value string) (*DrainKeys, error) {
+	keys := DrainKeys{keys: make(map[string][]byte)}
+	for _, pair := range strings.FieldsFunc(value, func(r rune) bool { return r == ',' || r == '\n' || r == '\r' }) {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		parts := strings.SplitN(pair, ":", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, errors.New("Drain encryption keys must be in the format id:key")
+		}
+		key, err := base64.StdEncoding.DecodeString(parts[1])
+		if err != nil || len(key) != 32 {
+			return nil, errors.New("The drain encryption key " + parts[0] + " must be 32 bytes encoded in base64")
+		}
+		if _, ok := keys.keys[parts[0]]; ok {
+			return nil, errors.New("The drain encryption key " + parts[0] + " is listed more than once")
+		}
+		if keys.primary == "" {
+			keys.primary = parts[0]
+		}
+		keys.keys[parts[0]] = key
+	}
+	if keys.primary == "" {
+		return nil, errors.New("No drain encryption keys were found")
+	}
+	return &keys, nil
+}
+
+// LoadDrainKeys reads the keys from DRAIN_ENCRYPTION_KEYS or the file in
+// DRAIN_ENCRYPTION_KEYS_FILE, nil is returned if neither is set.
+func LoadDrainKeys() (*DrainKeys, error) {
+	if os.Getenv("DRAIN_ENCRYPTION_KEYS") != "" {
+		return ParseDrainKeys(os.Getenv("DRAIN_ENCRYPTION_KEYS"))
+	}
+	if os.Getenv("DRAIN_ENCRYPTION_KEYS_FILE") != "" {
+		data, err := ioutil.ReadFile(os.Getenv("DRAIN_ENCRYPTION_KEYS_FILE"))
+		if err != nil {
+			return nil, err
+		}
+		return ParseDrainKeys(string(data))
+	}
+	return nil, nil
+}
+
+func seal(key []byte, plaintext []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+func unseal(key []byte, sealed []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return nil, errors.New("The encrypted value is too short")
+	}
+	return gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], nil)
+}
+
+// Encrypt encrypts the url with a new data key and the primary key.
+func (k *DrainKeys) Encrypt(plaintext string) (string, error) {
+	dataKey := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, dataKey); err != nil {
+		return "", err
+	}
+	wrappedKey, err := seal(k.keys[k.primary], dataKey)
+	if err != nil {
+		return "", err
+	}
+	ciphertext, err := seal(dataKey, []byte(plaintext))
+	if err != nil {
+		return "", err
+	}
+	return encryptedUrlPrefix + k.primary + ":" + base64.RawURLEncoding.EncodeToString(wrappedKey) + ":" + base64.RawURLEncoding.EncodeToString(ciphertext), nil
+}
+
+// Decrypt returns the url, values that aren't encrypted (e.g., stored before
+// encryption was enabled) are returned as they are.
+func (k *DrainKeys) Decrypt(value string) (string, error) {
+	if !strings.HasPrefix(value, encryptedUrlPrefix) {
+		return value, nil
+	}
+	parts := strings.Split(strings.TrimPrefix(value, encryptedUrlPrefix), ":")
+	if len(parts) != 3 {
+		return "", errors.New("The encrypted drain url is malformed")
+	}
+	key, ok := k.keys[parts[0]]
+	if !ok {
+		return "", errors.New("The drain url was encrypted with the unknown key " + parts[0])
+	}
+	wrappedKey, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", err
+	}
+	ciphertext, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", err
+	}
+	dataKey, err := unseal(key, wrappedKey)
+	if err != nil {
+		return "", errors.New("Unable to decrypt the drain url with the key " + parts[0])
+	}
+	plaintext, err := unseal(dataKey, ciphertext)
+	if err != nil {
+		return "", errors.New("Unable to decrypt the drain url with the key " + parts[0])
+	}
+	return string(plaintext), nil
+}
+
+// current checks the value is encrypted with the primary key.
+func (k *DrainKeys) current(value string) bool {
+	return strings.HasPrefix(value, encryptedUrlPrefix+k.primary+":")
+}
+
+// EncryptedStorage encrypts drain urls before they're stored (and sent to
+// route watchers) and decrypts them when they're read.
+type EncryptedStorage struct {
+	Storage
+	keys *DrainKeys
+}
+
+func NewEncryptedStorage(s Storage, keys *DrainKeys) *EncryptedStorage {
+	return &EncryptedStorage{Storage: s, keys: keys}
+}
+
+func (es *EncryptedStorage) encrypt(route Route) (Route, error) {
+	var err error
+	route.DestinationUrl, err = es.keys.Encrypt(route.DestinationUrl)
+	return route, err
+}
+
+func (es *EncryptedStorage) decrypt(route Route) (Route, error) {
+	var err error
+	route.DestinationUrl, err = es.keys.Decrypt(route.DestinationUrl)
+	return route, err
+}
+
+func (es *EncryptedStorage) decryptAll(routes []Route, err error) ([]Route, error) {
+	if err != nil {
+		return nil, err
+	}
+	for i, route := range routes {
+		if routes[i], err = es.decrypt(route); err != nil {
+			return nil, err
+		}
+	}
+	return routes, nil
+}
+
+func (es *EncryptedStorage) GetRoutes() ([]Route, error) {
+	return es.decryptAll(es.Storage.GetRoutes())
+}
+
+func (es *EncryptedStorage) GetRoutesByKey(key RouteKey) ([]Route, error) {
+	return es.decryptAll(es.Storage.GetRoutesByKey(key))
+}
+
+func (es *EncryptedStorage) GetRouteById(id string) (*Route, error) {
+	route, err := es.Storage.GetRouteById(id)
+	if err != nil {
+		return route, err
+	}
+	decrypted, err := es.decrypt(*route)
+	if err != nil {
+		return nil, err
+	}
+	return &decrypted, nil
+}
+
+func (es *EncryptedStorage) AddRoute(route Route) error {
+	encrypted, err := es.encrypt(route)
+	if err != nil {
+		return err
+	}
+	return es.Storage.AddRoute(encrypted)
+}
+
+func (es *EncryptedStorage) AddRoutes(routes []Route) error {
+	var encrypted = make([]Route, 0, len(routes))
+	for _, route := range routes {
+		route, err := es.encrypt(route)
+		if err != nil {
+			return err
+		}
+		encrypted = append(encrypted, route)
+	}
+	return es.Storage.AddRoutes(encrypted)
+}
+
+func (es *EncryptedStorage) UpdateRoute(route Route) error {
+	encrypted, err := es.encrypt(route)
+	if err != nil {
+		return err
+	}
+	return es.Storage.UpdateRoute(encrypted)
+}
+
+// RemoveRoute encrypts the url as the removed route is sent to route watchers.
+func (es *EncryptedStorage) RemoveRoute(route Route) error {
+	encrypted, err := es.encrypt(route)
+	if err != nil {
+		return err
+	}
+	return es.Storage.RemoveRoute(encrypted)
+}
+
+func (es *EncryptedStorage) WatchRoutes() (<-chan RouteChange, error) {
+	watcher, ok := es.Storage.(RouteWatcher)
+	if !ok {
+		return nil, errors.New("The storage can't watch for route changes")
+	}
+	encrypted, err := watcher.WatchRoutes()
+	if err != nil {
+		return nil, err
+	}
+	changes := make(chan RouteChange, 100)
+	go func() {
+		defer close(changes)
+		for change := range encrypted {
+			var err error
+			if change.Route, err = es.decrypt(change.Route); err != nil {
+				// reload everything rather than use a url we can't read.
+				change = RouteChange{Type: RoutesChanged}
+			}
+			changes <- change
+		}
+	}()
+	return changes, nil
+}
+
+// ReencryptRoutes encrypts urls that aren't encrypted with the primary key
+// (after a key is added or encryption is enabled), returning how many were.
+func (es *EncryptedStorage) ReencryptRoutes() (int, error) {
+	routes, err := es.Storage.GetRoutes()
+	if err != nil {
+		return 0, err
+	}
+	var count = 0
+	for _, route := range routes {
+		if es.keys.current(route.DestinationUrl) {
+			continue
+		}
+		if route, err = es.decrypt(route); err != nil {
+			return count, err
+		}
+		// the updated time is kept so the shuttle doesn't see a change.
+		if err = es.UpdateRoute(route); err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, nil
+}
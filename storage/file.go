@@ -0,0 +1,363 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrReadOnly is returned when changing routes or redaction rules that are
+// managed by a file.
+var ErrReadOnly = errors.New("Log drains and redaction rules are managed by a configuration file and cannot be changed through the API.")
+
+// How often the file (or directory) is checked for changes.
+const fileStoragePollInterval = time.Second * 10
+
+// fileConfig is the contents of a routes file, in yaml or json.
+type fileConfig struct {
+	Drains     []fileRoute     `json:"drains" yaml:"drains"`
+	Redactions []RedactionRule `json:"redactions" yaml:"redactions"`
+}
+
+type fileRoute struct {
+	Id      string        `json:"id" yaml:"id"`
+	App     string        `json:"app" yaml:"app"`
+	Space   string        `json:"space" yaml:"space"`
+	Site    string        `json:"site" yaml:"site"`
+	Url     string        `json:"url" yaml:"url"`
+	Filters *RouteFilters `json:"filters" yaml:"filters"`
+	Expires *time.Time    `json:"expires_at" yaml:"expires_at"`
+}
+
+// FileStorage reads routes and redaction rules from a yaml or json file, or
+// every .yaml, .yml and .json file in a directory, and reloads them when they
+// change. They can't be changed through the API, sessions are kept in memory.
+type FileStorage struct {
+	Storage
+	path        string
+	mutex       sync.RWMutex
+	routes      []Route
+	redactions  []RedactionRule
+	fingerprint string
+	loadErr     error
+	watchers    []chan RouteChange
+	sessions    MemoryStorage
+	done        chan struct{}
+	closed      bool
+	closeOnce   sync.Once
+}
+
+func (fs *FileStorage) HealthCheck() error {
+	fs.mutex.RLock()
+	defer fs.mutex.RUnlock()
+	return fs.loadErr
+}
+
+func (fs *FileStorage) Init(path string) error {
+	fs.path = path
+	fs.sessions.Init("")
+	fs.done = make(chan struct{})
+	if _, err := fs.reload(); err != nil {
+		return err
+	}
+	go fs.poll()
+	return nil
+}
+
+// Close stops polling for changes and closes the watchers' channels, it's
+// safe to call more than once or before Init.
+func (fs *FileStorage) Close() {
+	fs.closeOnce.Do(func() {
+		fs.mutex.Lock()
+		if fs.done != nil {
+			close(fs.done)
+		}
+		for _, watcher := range fs.watchers {
+			close(watcher)
+		}
+		fs.watchers = nil
+		fs.closed = true
+		fs.mutex.Unlock()
+		fs.sessions.Close()
+	})
+}
+
+// files returns the configuration files, sorted so routes load in the same order.
+func (fs *FileStorage) files() ([]string, error) {
+	info, err := os.Stat(fs.path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return []string{fs.path}, nil
+	}
+	entries, err := ioutil.ReadDir(fs.path)
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, entry := range entries {
+		switch strings.ToLower(filepath.Ext(entry.Name())) {
+		case ".yaml", ".yml", ".json":
+			if !entry.IsDir() {
+				files = append(files, filepath.Join(fs.path, entry.Name()))
+			}
+		}
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// reload reads the files if they've changed, returning whether they had. The
+// previous routes are kept if the files can't be read or are invalid.
+func (fs *FileStorage) reload() (bool, error) {
+	files, err := fs.files()
+	if err == nil {
+		var routes []Route
+		var redactions []RedactionRule
+		var fingerprint string
+		if routes, redactions, fingerprint, err = loadFiles(files); err == nil {
+			fs.mutex.Lock()
+			defer fs.mutex.Unlock()
+			fs.loadErr = nil
+			if fingerprint == fs.fingerprint {
+				return false, nil
+			}
+			fs.routes = keepTimestamps(fs.routes, routes)
+			fs.redactions = redactions
+			fs.fingerprint = fingerprint
+			return true, nil
+		}
+	}
+	fs.mutex.Lock()
+	fs.loadErr = err
+	fs.mutex.Unlock()
+	return false, err
+}
+
+// keepTimestamps carries over when unchanged routes were created and updated,
+// otherwise the shuttle would see every route in a changed file as updated.
+func keepTimestamps(previous []Route, routes []Route) []Route {
+	var existing = make(map[string]Route)
+	for _, r := range previous {
+		existing[r.Id] = r
+	}
+	for i, r := range routes {
+		if old, ok := existing[r.Id]; ok {
+			routes[i].Created = old.Created
+			if old.DestinationUrl == r.DestinationUrl && old.GetRouteKey() == r.GetRouteKey() && reflect.DeepEqual(old.Filters, r.Filters) && reflect.DeepEqual(old.Expires, r.Expires) {
+				routes[i].Updated = old.Updated
+			}
+		}
+	}
+	return routes
+}
+
+func (fs *FileStorage) poll() {
+	t := time.NewTicker(fileStoragePollInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-fs.done:
+			return
+		case <-t.C:
+			changed, err := fs.reload()
+			if err != nil {
+				log.Printf("[storage] Unable to reload %s, keeping the previous log drains: %s\n", fs.path, err)
+			} else if changed {
+				log.Printf("[storage] Reloaded log drains from %s\n", fs.path)
+				fs.notify(RouteChange{Type: RoutesChanged})
+			}
+		}
+	}
+}
+
+func (fs *FileStorage) notify(change RouteChange) {
+	fs.mutex.RLock()
+	defer fs.mutex.RUnlock()
+	for _, watcher := range fs.watchers {
+		select {
+		case watcher <- change:
+		default:
+		}
+	}
+}
+
+func (fs *FileStorage) WatchRoutes() (<-chan RouteChange, error) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	if fs.closed {
+		return nil, errStorageClosed
+	}
+	changes := make(chan RouteChange, 100)
+	fs.watchers = append(fs.watchers, changes)
+	return changes, nil
+}
+
+// loadFiles parses and validates the files, the fingerprint is a hash of their
+// contents so unchanged files aren't reloaded.
+func loadFiles(files []string) ([]Route, []RedactionRule, string, error) {
+	var routes []Route = make([]Route, 0)
+	var redactions []RedactionRule = make([]RedactionRule, 0)
+	var ids = make(map[string]string)
+	hash := sha1.New()
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			return nil, nil, "", err
+		}
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, nil, "", err
+		}
+		hash.Write([]byte(file))
+		hash.Write(data)
+		var config fileConfig
+		if strings.ToLower(filepath.Ext(file)) == ".json" {
+			decoder := json.NewDecoder(bytes.NewReader(data))
+			decoder.DisallowUnknownFields()
+			err = decoder.Decode(&config)
+		} else {
+			err = yaml.UnmarshalStrict(data, &config)
+		}
+		if err != nil {
+			return nil, nil, "", fmt.Errorf("%s: %s", file, err)
+		}
+		for _, fr := range config.Drains {
+			route := Route{Id: fr.Id, App: fr.App, Space: fr.Space, Site: fr.Site, DestinationUrl: fr.Url, Filters: fr.Filters, Expires: fr.Expires, Created: info.ModTime(), Updated: info.ModTime()}
+			if err = validateFileRoute(route); err != nil {
+				return nil, nil, "", fmt.Errorf("%s: %s", file, err)
+			}
+			if other, ok := ids[route.Id]; ok {
+				return nil, nil, "", fmt.Errorf("%s: the drain %s is also in %s", file, route.Id, other)
+			}
+			ids[route.Id] = file
+			routes = append(routes, route)
+		}
+		for _, rule := range config.Redactions {
+			if rule.Id == "" || rule.App == "" || rule.Space == "" || rule.Pattern == "" {
+				return nil, nil, "", fmt.Errorf("%s: redaction rules need an id, app, space and pattern", file)
+			}
+			if _, err = regexp.Compile(rule.Pattern); err != nil {
+				return nil, nil, "", fmt.Errorf("%s: the redaction rule %s has an invalid pattern: %s", file, rule.Id, err)
+			}
+			if rule.Created.IsZero() {
+				rule.Created = info.ModTime()
+			}
+			redactions = append(redactions, rule)
+		}
+	}
+	return routes, redactions, hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+func validateFileRoute(route Route) error {
+	if route.Id == "" {
+		return errors.New("every drain needs an id")
+	}
+	if route.DestinationUrl == "" {
+		return errors.New("the drain " + route.Id + " has no url")
+	}
+	if route.Site == "" && route.Space == "" {
+		return errors.New("the drain " + route.Id + " needs a site, a space or an app and space")
+	}
+	if route.Site != "" && (route.App != "" || route.Space != "") {
+		return errors.New("the drain " + route.Id + " can't have both a site and an app or space")
+	}
+	if route.Filters != nil {
+		if err := route.Filters.Validate(); err != nil {
+			return errors.New("the drain " + route.Id + " has invalid filters: " + err.Error())
+		}
+	}
+	return nil
+}
+
+func (fs *FileStorage) SetSession(key string, value LogSession, duration time.Duration) error {
+	return fs.sessions.SetSession(key, value, duration)
+}
+
+func (fs *FileStorage) GetSession(key string) (LogSession, error) {
+	return fs.sessions.GetSession(key)
+}
+
+func (fs *FileStorage) GetRoutes() ([]Route, error) {
+	fs.mutex.RLock()
+	defer fs.mutex.RUnlock()
+	return append([]Route{}, fs.routes...), nil
+}
+
+func (fs *FileStorage) GetRoutesByKey(key RouteKey) ([]Route, error) {
+	fs.mutex.RLock()
+	defer fs.mutex.RUnlock()
+	var routes []Route = make([]Route, 0)
+	for _, r := range fs.routes {
+		if r.GetRouteKey() == key {
+			routes = append(routes, r)
+		}
+	}
+	return routes, nil
+}
+
+func (fs *FileStorage) GetRouteById(Id string) (*Route, error) {
+	fs.mutex.RLock()
+	defer fs.mutex.RUnlock()
+	for _, r := range fs.routes {
+		if r.Id == Id {
+			return &r, nil
+		}
+	}
+	return nil, ErrRouteNotFound
+}
+
+func (fs *FileStorage) RemoveRoute(route Route) error {
+	return ErrReadOnly
+}
+
+func (fs *FileStorage) AddRoute(route Route) error {
+	return ErrReadOnly
+}
+
+func (fs *FileStorage) AddRoutes(routes []Route) error {
+	return ErrReadOnly
+}
+
+func (fs *FileStorage) UpdateRoute(route Route) error {
+	return ErrReadOnly
+}
+
+func (fs *FileStorage) GetRedactionRules() ([]RedactionRule, error) {
+	fs.mutex.RLock()
+	defer fs.mutex.RUnlock()
+	return append([]RedactionRule{}, fs.redactions...), nil
+}
+
+func (fs *FileStorage) AddRedactionRule(rule RedactionRule) error {
+	return ErrReadOnly
+}
+
+func (fs *FileStorage) RemoveRedactionRule(rule RedactionRule) error {
+	return ErrReadOnly
+}
+
+// AddRouteAudit fails as routes can't be changed, their history is the
+// history of the file.
+func (fs *FileStorage) AddRouteAudit(audit RouteAudit) error {
+	return ErrReadOnly
+}
+
+func (fs *FileStorage) GetRouteAudits(key RouteKey) ([]RouteAudit, error) {
+	return make([]RouteAudit, 0), nil
+}
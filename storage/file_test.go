@@ -0,0 +1,116 @@
+package storage
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileStorage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logshuttle-routes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "security.yaml"), []byte(`
+drains:
+  - id: siem
+    space: prod
+    url: syslog+tls://siem.example.com:6514
+    filters:
+      exclude_sources: [build]
+  - id: api-papertrail
+    app: api
+    space: prod
+    url: syslog+tls://logs.papertrailapp.com:44112
+    expires_at: 2100-01-02T15:04:05Z
+redactions:
+  - id: api-tokens
+    app: api
+    space: prod
+    pattern: token=\S+
+    replacement: token=[redacted]
+`), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "sites.json"), []byte(`{"drains":[{"id":"www","site":"www.example.com","url":"https://logs.example.com/www"}]}`), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "README.md"), []byte("not a routes file"), 0644)
+
+	var fs FileStorage
+	Convey("Ensure routes and redaction rules are read from yaml and json files.", t, func() {
+		So(fs.Init(dir), ShouldEqual, nil)
+		routes, err := fs.GetRoutes()
+		So(err, ShouldEqual, nil)
+		So(len(routes), ShouldEqual, 3)
+		routes, err = fs.GetRoutesByKey(SpaceRouteKey("prod"))
+		So(err, ShouldEqual, nil)
+		So(len(routes), ShouldEqual, 1)
+		So(routes[0].Filters.ExcludeSources, ShouldResemble, []string{"build"})
+		route, err := fs.GetRouteById("www")
+		So(err, ShouldEqual, nil)
+		So(route.Kind(), ShouldEqual, RouteKindSite)
+		So(route.Expires, ShouldBeNil)
+		route, err = fs.GetRouteById("api-papertrail")
+		So(err, ShouldEqual, nil)
+		So(route.Expires.Equal(time.Date(2100, 1, 2, 15, 4, 5, 0, time.UTC)), ShouldBeTrue)
+		rules, err := fs.GetRedactionRules()
+		So(err, ShouldEqual, nil)
+		So(len(rules), ShouldEqual, 1)
+		So(rules[0].Replacement, ShouldEqual, "token=[redacted]")
+	})
+
+	Convey("Ensure routes and redaction rules can't be changed.", t, func() {
+		So(fs.AddRoute(Route{Id: "new", Space: "prod", DestinationUrl: "syslog://example.com"}), ShouldEqual, ErrReadOnly)
+		So(fs.RemoveRoute(Route{Id: "siem"}), ShouldEqual, ErrReadOnly)
+		So(fs.UpdateRoute(Route{Id: "siem"}), ShouldEqual, ErrReadOnly)
+		So(fs.AddRedactionRule(RedactionRule{Id: "new"}), ShouldEqual, ErrReadOnly)
+		routes, _ := fs.GetRoutes()
+		So(len(routes), ShouldEqual, 3)
+	})
+
+	Convey("Ensure changes are reloaded and unchanged routes keep their timestamps.", t, func() {
+		before, _ := fs.GetRouteById("api-papertrail")
+		changes, err := fs.WatchRoutes()
+		So(err, ShouldEqual, nil)
+		ioutil.WriteFile(filepath.Join(dir, "sites.json"), []byte(`{"drains":[{"id":"www","site":"www.example.com","url":"https://logs.example.com/www2"}]}`), 0644)
+		changed, err := fs.reload()
+		So(err, ShouldEqual, nil)
+		So(changed, ShouldEqual, true)
+		route, _ := fs.GetRouteById("www")
+		So(route.DestinationUrl, ShouldEqual, "https://logs.example.com/www2")
+		after, _ := fs.GetRouteById("api-papertrail")
+		So(after.Updated == before.Updated, ShouldBeTrue)
+		fs.notify(RouteChange{Type: RoutesChanged})
+		change := <-changes
+		So(change.Type, ShouldEqual, RoutesChanged)
+	})
+
+	Convey("Ensure invalid files are reported and the previous routes are kept.", t, func() {
+		ioutil.WriteFile(filepath.Join(dir, "broken.yaml"), []byte("drains:\n  - id: siem\n    space: dev\n    url: syslog://example.com\n"), 0644)
+		_, err := fs.reload()
+		So(err, ShouldNotEqual, nil)
+		So(fs.HealthCheck(), ShouldNotEqual, nil)
+		routes, _ := fs.GetRoutes()
+		So(len(routes), ShouldEqual, 3)
+		os.Remove(filepath.Join(dir, "broken.yaml"))
+		_, err = fs.reload()
+		So(err, ShouldEqual, nil)
+		So(fs.HealthCheck(), ShouldEqual, nil)
+	})
+
+	Convey("Ensure closing stops its watchers and can be done more than once.", t, func() {
+		changes, err := fs.WatchRoutes()
+		So(err, ShouldEqual, nil)
+		fs.Close()
+		fs.Close()
+		_, open := <-changes
+		So(open, ShouldEqual, false)
+		_, err = fs.WatchRoutes()
+		So(err, ShouldNotEqual, nil)
+		fs.notify(RouteChange{Type: RoutesChanged})
+		var unused FileStorage
+		unused.Close()
+		unused.Close()
+	})
+}
@@ -0,0 +1,129 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"log"
+)
+
+// A migration upgrades the postgres schema from the previous version, they're
+// applied in order and recorded in schema_migrations. Never change a migration
+// that has been released, add a new one instead.
+type migration struct {
+	Version    int
+	Name       string
+	Statements []string
+}
+
+// The first migration uses "if not exists" so databases created before
+// migrations were versioned are adopted rather than recreated.
+var postgresMigrations = []migration{
+	{1, "create drains, redactions and sessions", []string{
+		"create table if not exists drains (drain varchar(128) not null primary key, site text not null default '', app text not null default '', space text not null default '', created timestamptz, updated timestamptz, destination text not null)",
+		"create table if not exists redactions (redaction varchar(128) not null primary key, app text not null, space text not null, pattern text not null, replacement text not null default '', created timestamptz)",
+		"create table if not exists sessions (session varchar(128) not null primary key, site text not null default '', app text not null default '', space text not null default '', lines int, tail boolean, expiration timestamptz default now())",
+	}},
+	{2, "add filters to drains", []string{
+		"alter table drains add column if not exists filters text not null default ''",
+	}},
+	{3, "index drains by app, space and site and sessions by expiration", []string{
+		"create index if not exists drains_app_space on drains (app, space)",
+		"create index if not exists drains_site on drains (site)",
+		"create index if not exists sessions_expiration on sessions (expiration)",
+	}},
+	{4, "create drain_audits", []string{
+		"create table if not exists drain_audits (audit varchar(128) not null primary key, drain varchar(128) not null, action text not null, site text not null default '', app text not null default '', space text not null default '', actor text not null default '', caller text not null default '', before text not null default '', after text not null default '', created timestamptz not null default now())",
+		"create index if not exists drain_audits_app_space on drain_audits (app, space, created)",
+		"create index if not exists drain_audits_site on drain_audits (site, created)",
+	}},
+	{5, "add expires to drains", []string{
+		"alter table drains add column if not exists expires timestamptz",
+	}},
+	{6, "add forwarded_for to drain_audits", []string{
+		"alter table drain_audits add column if not exists forwarded_for text not null default ''",
+	}},
+}
+
+// Held while migrating so shuttles starting at the same time don't race.
+const postgresMigrationLock = 4521873009
+
+// MigratePostgres applies any migrations the database doesn't have yet.
+func MigratePostgres(url string) error {
+	db, err := sql.Open("postgres", url)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return migratePostgres(db, postgresMigrations)
+}
+
+func migratePostgres(db *sql.DB, migrations []migration) error {
+	ctx := context.Background()
+	// advisory locks belong to a session, so use one connection throughout.
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if _, err = conn.ExecContext(ctx, "select pg_advisory_lock($1)", postgresMigrationLock); err != nil {
+		return err
+	}
+	defer conn.ExecContext(ctx, "select pg_advisory_unlock($1)", postgresMigrationLock)
+
+	_, err = conn.ExecContext(ctx, "create table if not exists schema_migrations (version int not null primary key, name text not null, applied timestamptz not null default now())")
+	if err != nil {
+		return err
+	}
+	applied, err := appliedMigrations(ctx, conn)
+	if err != nil {
+		return err
+	}
+	for _, m := range migrations {
+		if applied[m.Version] {
+			continue
+		}
+		if err = applyMigration(ctx, conn, m); err != nil {
+			log.Printf("[storage] Unable to apply migration %d (%s): %s\n", m.Version, m.Name, err)
+			return err
+		}
+		log.Printf("[storage] Applied migration %d (%s)\n", m.Version, m.Name)
+	}
+	return nil
+}
+
+func appliedMigrations(ctx context.Context, conn *sql.Conn) (map[int]bool, error) {
+	rows, err := conn.QueryContext(ctx, "select version from schema_migrations")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var applied = make(map[int]bool)
+	for rows.Next() {
+		var version int
+		if err = rows.Scan(&version); err != nil {
+			return nil, err
+		}
+		applied[version] = true
+	}
+	return applied, rows.Err()
+}
+
+// applyMigration runs the statements and records the version in one
+// transaction, so a failed migration leaves nothing behind.
+func applyMigration(ctx context.Context, conn *sql.Conn, m migration) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	for _, statement := range m.Statements {
+		if _, err = tx.ExecContext(ctx, statement); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	if _, err = tx.ExecContext(ctx, "insert into schema_migrations (version, name) values ($1, $2)", m.Version, m.Name); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
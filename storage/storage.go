@@ -1,12 +1,24 @@
 package storage
 
 import (
+	"crypto/tls"
 	"database/sql"
 	"encoding/json"
 	"errors"
+	"github.com/akkeris/logshuttle/syslog"
+	"github.com/akkeris/logshuttle/urls"
 	"gopkg.in/redis.v4"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 )
 
 type Route struct {
@@ -17,6 +29,79 @@ type Route struct {
 	Created        time.Time `json:"created"`
 	Updated        time.Time `json:"updated"`
 	DestinationUrl string    `json:"url"`
+	Filters        *RouteFilters `json:"filters,omitempty"`
+	Expires        *time.Time    `json:"expires,omitempty"`
+}
+
+// Expired is true if the route has an expiration and it has passed.
+func (rt *Route) Expired(now time.Time) bool {
+	return rt.Expires != nil && !now.Before(*rt.Expires)
+}
+
+// The sources a route can filter on.
+var RouteSources = []string{"app", "router", "build"}
+
+// RouteFilters limit which logs a route receives, empty fields allow all.
+type RouteFilters struct {
+	Sources        []string `json:"sources,omitempty" yaml:"sources,omitempty"`
+	ExcludeSources []string `json:"exclude_sources,omitempty" yaml:"exclude_sources,omitempty"`
+	ProcessTypes   []string `json:"process_types,omitempty" yaml:"process_types,omitempty"`
+	MinSeverity    string   `json:"min_severity,omitempty" yaml:"min_severity,omitempty"`
+	Include        string   `json:"include,omitempty" yaml:"include,omitempty"`
+	Exclude        string   `json:"exclude,omitempty" yaml:"exclude,omitempty"`
+}
+
+func isRouteSource(source string) bool {
+	for _, s := range RouteSources {
+		if s == source {
+			return true
+		}
+	}
+	return false
+}
+
+// Validate ensures the sources and severity are known and the include and
+// exclude patterns are valid regular expressions.
+func (f *RouteFilters) Validate() error {
+	for _, source := range append(append([]string{}, f.Sources...), f.ExcludeSources...) {
+		if !isRouteSource(source) {
+			return errors.New("Unknown source " + source + ", must be one of " + strings.Join(RouteSources, ", "))
+		}
+	}
+	if f.MinSeverity != "" {
+		if _, err := syslog.Severity(f.MinSeverity); err != nil {
+			return errors.New("Unknown severity " + f.MinSeverity)
+		}
+	}
+	if _, err := regexp.Compile(f.Include); err != nil {
+		return errors.New("Invalid include pattern: " + err.Error())
+	}
+	if _, err := regexp.Compile(f.Exclude); err != nil {
+		return errors.New("Invalid exclude pattern: " + err.Error())
+	}
+	return nil
+}
+
+// ErrRouteNotFound is returned when a route doesn't exist, e.g., when it's
+// removed by someone else first.
+var ErrRouteNotFound = errors.New("No such drain found.")
+
+// errStorageClosed is returned when watching for changes after Close.
+var errStorageClosed = errors.New("The storage has been closed.")
+
+// ErrRedactionRuleNotFound is returned when removing a redaction rule that
+// doesn't exist (e.g., it was already removed).
+var ErrRedactionRuleNotFound = errors.New("No such redaction rule found.")
+
+// RedactionRule masks matches of Pattern (a regular expression) in an app's
+// logs with Replacement, which may refer to submatches (e.g., ${1}).
+type RedactionRule struct {
+	Id          string    `json:"id"`
+	Space       string    `json:"space"`
+	App         string    `json:"app"`
+	Pattern     string    `json:"pattern"`
+	Replacement string    `json:"replacement"`
+	Created     time.Time `json:"created"`
 }
 
 type LogSession struct {
@@ -33,13 +118,69 @@ type Storage interface {
 	SetSession(key string, value LogSession, duration time.Duration) error
 	GetSession(key string) (LogSession, error)
 	GetRoutes() ([]Route, error)
+	GetRoutesByKey(key RouteKey) ([]Route, error)
 	GetRouteById(id string) (*Route, error)
 	RemoveRoute(route Route) error
 	AddRoute(route Route) error
 	AddRoutes([]Route) error
+	// UpdateRoute changes the url, filters, expiry and updated time of an
+	// existing route, its site, app, space and created time are kept.
+	UpdateRoute(route Route) error
+	GetRedactionRules() ([]RedactionRule, error)
+	AddRedactionRule(rule RedactionRule) error
+	RemoveRedactionRule(rule RedactionRule) error
+	AddRouteAudit(audit RouteAudit) error
+	GetRouteAudits(key RouteKey) ([]RouteAudit, error)
 	Close()
 }
 
+// The types of route changes sent to watchers, RoutesChanged means changes
+// may have been missed (e.g., a reconnect) and all routes should be reloaded.
+const (
+	RouteAdded    = "added"
+	RouteUpdated  = "updated"
+	RouteRemoved  = "removed"
+	RoutesChanged = "changed"
+)
+
+// RouteChange is sent to watchers, changes published through redis or
+// postgres only have the route's id so watchers should read the route from
+// storage.
+type RouteChange struct {
+	Type  string `json:"type"`
+	Route Route  `json:"route"`
+}
+
+// RouteWatcher is optionally implemented by storage that can notify of route
+// changes as they happen, the channel is closed if watching stops.
+type RouteWatcher interface {
+	WatchRoutes() (<-chan RouteChange, error)
+}
+
+// The redis channel and postgres notification channel route changes are sent on.
+const routeChangesChannel = "route_changes"
+
+// routeChangeNotice is what's published on the route changes channel, only the
+// id so drain urls (and credentials in them) can't be read by anyone able to
+// subscribe or listen.
+type routeChangeNotice struct {
+	Type string `json:"type"`
+	Id   string `json:"id"`
+}
+
+func marshalRouteChange(changeType string, route Route) (string, error) {
+	bytes, err := json.Marshal(routeChangeNotice{Type: changeType, Id: route.Id})
+	return string(bytes), err
+}
+
+func unmarshalRouteChange(payload string) RouteChange {
+	var notice routeChangeNotice
+	if err := json.Unmarshal([]byte(payload), &notice); err != nil || notice.Id == "" {
+		return RouteChange{Type: RoutesChanged}
+	}
+	return RouteChange{Type: notice.Type, Route: Route{Id: notice.Id}}
+}
+
 func MarshalRoute(route Route) (string, error) {
 	bytes, err := json.Marshal(route)
 	if err != nil {
@@ -56,19 +197,95 @@ func UnmarshalRoute(route string) (Route, error) {
 	return r, nil
 }
 
-func (rt *Route) GetRouteKey() string {
+func marshalFilters(filters *RouteFilters) (string, error) {
+	if filters == nil {
+		return "", nil
+	}
+	bytes, err := json.Marshal(filters)
+	return string(bytes), err
+}
+
+func unmarshalFilters(filters string) (*RouteFilters, error) {
+	if filters == "" {
+		return nil, nil
+	}
+	var f RouteFilters
+	if err := json.Unmarshal([]byte(filters), &f); err != nil {
+		return nil, err
+	}
+	return &f, nil
+}
+
+// The kinds of routes, an app route receives logs for an app (app-space), a
+// site route for a site and a space route for every app in a space.
+const (
+	RouteKindApp   = "app"
+	RouteKindSite  = "site"
+	RouteKindSpace = "space"
+)
+
+func (rt *Route) Kind() string {
 	if rt.Site != "" {
-		return rt.Site
+		return RouteKindSite
+	} else if rt.App == "" && rt.Space != "" {
+		return RouteKindSpace
 	} else {
-		return rt.App + rt.Space
+		return RouteKindApp
 	}
 }
 
+// RouteKey identifies who a route receives logs for, only the fields for
+// its kind are set so keys of different kinds never collide.
+type RouteKey struct {
+	Kind  string
+	App   string
+	Space string
+	Site  string
+}
+
+func AppRouteKey(app string, space string) RouteKey {
+	return RouteKey{Kind: RouteKindApp, App: app, Space: space}
+}
+
+func SiteRouteKey(site string) RouteKey {
+	return RouteKey{Kind: RouteKindSite, Site: site}
+}
+
+func SpaceRouteKey(space string) RouteKey {
+	return RouteKey{Kind: RouteKindSpace, Space: space}
+}
+
+func (k RouteKey) String() string {
+	switch k.Kind {
+	case RouteKindSite:
+		return "site " + k.Site
+	case RouteKindSpace:
+		return "space " + k.Space
+	default:
+		return "app " + k.App + "-" + k.Space
+	}
+}
+
+func (rt *Route) GetRouteKey() RouteKey {
+	switch rt.Kind() {
+	case RouteKindSite:
+		return SiteRouteKey(rt.Site)
+	case RouteKindSpace:
+		return SpaceRouteKey(rt.Space)
+	default:
+		return AppRouteKey(rt.App, rt.Space)
+	}
+}
+
+// GetRouteString describes the route for logs, credentials in the url are redacted.
 func (rt *Route) GetRouteString() string {
-	if rt.Site != "" {
-		return rt.Site + " -> " + rt.DestinationUrl
-	} else {
-		return rt.Space + "-" + rt.App + " -> " + rt.DestinationUrl
+	switch rt.Kind() {
+	case RouteKindSite:
+		return rt.Site + " -> " + urls.Redact(rt.DestinationUrl)
+	case RouteKindSpace:
+		return "space " + rt.Space + " -> " + urls.Redact(rt.DestinationUrl)
+	default:
+		return rt.Space + "-" + rt.App + " -> " + urls.Redact(rt.DestinationUrl)
 	}
 }
 
@@ -78,6 +295,8 @@ type PostgresStorage struct {
 	Storage
 	client *sql.DB
 	open bool
+	url string
+	listener *pq.Listener
 }
 
 func (rs *PostgresStorage) HealthCheck() error {
@@ -97,16 +316,13 @@ func (rs *PostgresStorage) Init(url string) error {
 	if err != nil {
 		return err
 	}
-	_, err = db.Exec("create table if not exists drains (drain varchar(128) not null primary key, site text not null default '', app text not null default '', space text not null default '', created timestamptz, updated timestamptz, destination text not null)")
-	if err != nil {
-		return err
-	}
-	_, err = db.Exec("create table if not exists sessions (session varchar(128) not null primary key, site text not null default '', app text not null default '', space text not null default '', lines int, tail boolean, expiration timestamptz default now())")
-	if err != nil {
+	if err = migratePostgres(db, postgresMigrations); err != nil {
+		db.Close()
 		return err
 	}
 	rs.open = true
 	rs.client = db
+	rs.url = url
 
 	t := time.NewTicker(time.Second * 60)
 	go func() {
@@ -119,6 +335,10 @@ func (rs *PostgresStorage) Init(url string) error {
 }
 
 func (rs *PostgresStorage) Close() {
+	if rs.listener != nil {
+		rs.listener.Close()
+		rs.listener = nil
+	}
 	if rs.open == true {
 		rs.client.Close()
 	}
@@ -137,7 +357,22 @@ func (rs *PostgresStorage) GetSession(key string) (value LogSession, err error)
 }
 
 func (rs *PostgresStorage) GetRoutes() ([]Route, error) {
-	rows, err := rs.client.Query("select drain, site, app, space, created, updated, destination from drains")
+	return rs.queryRoutes("select drain, site, app, space, created, updated, destination, filters, expires from drains")
+}
+
+func (rs *PostgresStorage) GetRoutesByKey(key RouteKey) ([]Route, error) {
+	switch key.Kind {
+	case RouteKindSite:
+		return rs.queryRoutes("select drain, site, app, space, created, updated, destination, filters, expires from drains where site=$1", key.Site)
+	case RouteKindSpace:
+		return rs.queryRoutes("select drain, site, app, space, created, updated, destination, filters, expires from drains where site='' and app='' and space=$1", key.Space)
+	default:
+		return rs.queryRoutes("select drain, site, app, space, created, updated, destination, filters, expires from drains where site='' and app=$1 and space=$2", key.App, key.Space)
+	}
+}
+
+func (rs *PostgresStorage) queryRoutes(query string, args ...interface{}) ([]Route, error) {
+	rows, err := rs.client.Query(query, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -145,10 +380,14 @@ func (rs *PostgresStorage) GetRoutes() ([]Route, error) {
 	var routes []Route = make([]Route, 0)
 	for rows.Next() {
 		var route Route
-		err = rows.Scan(&route.Id, &route.Site, &route.App, &route.Space, &route.Created, &route.Updated, &route.DestinationUrl)
+		var filters string
+		err = rows.Scan(&route.Id, &route.Site, &route.App, &route.Space, &route.Created, &route.Updated, &route.DestinationUrl, &filters, &route.Expires)
 		if err != nil {
 			return nil, err
 		}
+		if route.Filters, err = unmarshalFilters(filters); err != nil {
+			return nil, err
+		}
 		routes = append(routes, route)
 	}
 	err = rows.Err()
@@ -160,18 +399,92 @@ func (rs *PostgresStorage) GetRoutes() ([]Route, error) {
 
 func (rs *PostgresStorage) GetRouteById(Id string) (*Route, error) {
 	var route Route
-	err := rs.client.QueryRow("select drain, site, app, space, created, updated, destination from drains where drain=$1", Id).Scan(&route.Id, &route.Site, &route.App, &route.Space, &route.Created, &route.Updated, &route.DestinationUrl)
+	var filters string
+	err := rs.client.QueryRow("select drain, site, app, space, created, updated, destination, filters, expires from drains where drain=$1", Id).Scan(&route.Id, &route.Site, &route.App, &route.Space, &route.Created, &route.Updated, &route.DestinationUrl, &filters, &route.Expires)
+	if err != nil {
+		return &route, err
+	}
+	route.Filters, err = unmarshalFilters(filters)
 	return &route, err
 }
 
 func (rs *PostgresStorage) RemoveRoute(route Route) error {
-	_, err := rs.client.Exec("delete from drains where drain=$1", route.Id)
-	return err
+	result, err := rs.client.Exec("delete from drains where drain=$1", route.Id)
+	if err != nil {
+		return err
+	}
+	count, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return ErrRouteNotFound
+	}
+	rs.notify(RouteRemoved, route)
+	return nil
+}
+
+// notify tells watchers of a route change, failures are only a delay as the
+// shuttle still polls for changes.
+func (rs *PostgresStorage) notify(changeType string, route Route) {
+	payload, err := marshalRouteChange(changeType, route)
+	if err != nil {
+		return
+	}
+	rs.client.Exec("select pg_notify($1, $2)", routeChangesChannel, payload)
+}
+
+func (rs *PostgresStorage) WatchRoutes() (<-chan RouteChange, error) {
+	listener := pq.NewListener(rs.url, time.Second, time.Minute, nil)
+	if err := listener.Listen(routeChangesChannel); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	rs.listener = listener
+	changes := make(chan RouteChange, 100)
+	go func() {
+		defer close(changes)
+		for n := range listener.Notify {
+			// a nil notification means the connection was re-established.
+			if n == nil {
+				changes <- RouteChange{Type: RoutesChanged}
+			} else {
+				changes <- unmarshalRouteChange(n.Extra)
+			}
+		}
+	}()
+	return changes, nil
 }
 
 func (rs *PostgresStorage) AddRoute(route Route) error {
-	_, err := rs.client.Exec("insert into drains (drain, site, app, space, created, updated, destination) values ($1, $2, $3, $4, $5, $6, $7) on conflict do nothing", route.Id, route.Site, route.App, route.Space, route.Created, route.Updated, route.DestinationUrl)
-	return err
+	filters, err := marshalFilters(route.Filters)
+	if err != nil {
+		return err
+	}
+	_, err = rs.client.Exec("insert into drains (drain, site, app, space, created, updated, destination, filters, expires) values ($1, $2, $3, $4, $5, $6, $7, $8, $9) on conflict do nothing", route.Id, route.Site, route.App, route.Space, route.Created, route.Updated, route.DestinationUrl, filters, route.Expires)
+	if err != nil {
+		return err
+	}
+	rs.notify(RouteAdded, route)
+	return nil
+}
+
+// UpdateRoute changes the url, filters, expiry and updated time of an existing
+// route.
+func (rs *PostgresStorage) UpdateRoute(route Route) error {
+	filters, err := marshalFilters(route.Filters)
+	if err != nil {
+		return err
+	}
+	result, err := rs.client.Exec("update drains set destination=$2, filters=$3, updated=$4, expires=$5 where drain=$1", route.Id, route.DestinationUrl, filters, route.Updated, route.Expires)
+	if err != nil {
+		return err
+	}
+	if count, err := result.RowsAffected(); err == nil && count == 0 {
+		return ErrRouteNotFound
+	}
+	rs.notify(RouteUpdated, route)
+	return nil
 }
 
 func (rs *PostgresStorage) AddRoutes(routes []Route) (err error) {
@@ -185,12 +498,163 @@ func (rs *PostgresStorage) AddRoutes(routes []Route) (err error) {
 }
 
 
+func (rs *PostgresStorage) GetRedactionRules() ([]RedactionRule, error) {
+	rows, err := rs.client.Query("select redaction, app, space, pattern, replacement, created from redactions")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var rules []RedactionRule = make([]RedactionRule, 0)
+	for rows.Next() {
+		var rule RedactionRule
+		if err = rows.Scan(&rule.Id, &rule.App, &rule.Space, &rule.Pattern, &rule.Replacement, &rule.Created); err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	return rules, rows.Err()
+}
+
+func (rs *PostgresStorage) AddRedactionRule(rule RedactionRule) error {
+	_, err := rs.client.Exec("insert into redactions (redaction, app, space, pattern, replacement, created) values ($1, $2, $3, $4, $5, $6) on conflict do nothing", rule.Id, rule.App, rule.Space, rule.Pattern, rule.Replacement, rule.Created)
+	return err
+}
+
+func (rs *PostgresStorage) RemoveRedactionRule(rule RedactionRule) error {
+	result, err := rs.client.Exec("delete from redactions where redaction=$1", rule.Id)
+	if err != nil {
+		return err
+	}
+	count, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return ErrRedactionRuleNotFound
+	}
+	return nil
+}
 
 // Redis Interface
 
+// redisClient is implemented by single node, sentinel and cluster clients.
+type redisClient interface {
+	redis.Cmdable
+	Publish(channel, message string) *redis.IntCmd
+	Watch(fn func(*redis.Tx) error, keys ...string) error
+	Close() error
+}
+
 type RedisStorage struct {
 	Storage
-	client *redis.Client
+	client redisClient
+	// subscriber receives route changes, the cluster client can't subscribe
+	// so a client to one of its nodes is used (messages reach every node).
+	subscriber *redis.Client
+}
+
+// RedisOptions are parsed from a redis url, see ParseRedisURL.
+type RedisOptions struct {
+	Addrs          []string
+	Password       string
+	DB             int
+	TLS            bool
+	SentinelMaster string
+	Cluster        bool
+}
+
+// ParseRedisURL parses redis://[:password@]host[:port][/db] urls, rediss://
+// connects with TLS. Several comma separated hosts may be given with either
+// ?sentinel=master (the hosts are sentinels) or ?cluster=true (the hosts are
+// cluster nodes). A plain host:port is also accepted.
+func ParseRedisURL(rawurl string) (*RedisOptions, error) {
+	if !strings.Contains(rawurl, "://") {
+		rawurl = "redis://" + rawurl
+	}
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	var opts RedisOptions
+	switch u.Scheme {
+	case "redis":
+	case "rediss":
+		opts.TLS = true
+	default:
+		return nil, errors.New("Unknown redis url scheme " + u.Scheme + ", must be redis or rediss")
+	}
+	if u.Host == "" {
+		return nil, errors.New("The redis url is missing a host")
+	}
+	for _, addr := range strings.Split(u.Host, ",") {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			addr = net.JoinHostPort(addr, "6379")
+		}
+		opts.Addrs = append(opts.Addrs, addr)
+	}
+	if u.User != nil {
+		opts.Password, _ = u.User.Password()
+	}
+	if db := strings.Trim(u.Path, "/"); db != "" {
+		if opts.DB, err = strconv.Atoi(db); err != nil {
+			return nil, errors.New("Invalid redis database " + db)
+		}
+	}
+	query := u.Query()
+	opts.SentinelMaster = query.Get("sentinel")
+	opts.Cluster = query.Get("cluster") == "true"
+	if opts.SentinelMaster != "" && opts.Cluster {
+		return nil, errors.New("A redis url can't be both sentinel and cluster")
+	}
+	// the redis client only supports a custom (TLS) dialer for a single node.
+	if opts.TLS && (opts.SentinelMaster != "" || opts.Cluster) {
+		return nil, errors.New("TLS (rediss) is not supported with sentinel or cluster")
+	}
+	if opts.Cluster && opts.DB != 0 {
+		return nil, errors.New("Redis cluster only supports database 0")
+	}
+	if len(opts.Addrs) > 1 && opts.SentinelMaster == "" && !opts.Cluster {
+		return nil, errors.New("Multiple redis hosts require either ?sentinel=master or ?cluster=true")
+	}
+	return &opts, nil
+}
+
+// connect creates the client (and subscriber) for the options.
+func (rs *RedisStorage) connect(opts *RedisOptions) {
+	if opts.Cluster {
+		rs.client = redis.NewClusterClient(&redis.ClusterOptions{
+			Addrs:    opts.Addrs,
+			Password: opts.Password,
+		})
+		rs.subscriber = redis.NewClient(&redis.Options{
+			Addr:     opts.Addrs[0],
+			Password: opts.Password,
+		})
+	} else if opts.SentinelMaster != "" {
+		client := redis.NewFailoverClient(&redis.FailoverOptions{
+			MasterName:    opts.SentinelMaster,
+			SentinelAddrs: opts.Addrs,
+			Password:      opts.Password,
+			DB:            opts.DB,
+		})
+		rs.client = client
+		rs.subscriber = client
+	} else {
+		options := &redis.Options{
+			Addr:     opts.Addrs[0],
+			Password: opts.Password,
+			DB:       opts.DB,
+		}
+		if opts.TLS {
+			host, _, _ := net.SplitHostPort(opts.Addrs[0])
+			options.Dialer = func() (net.Conn, error) {
+				return tls.DialWithDialer(&net.Dialer{Timeout: time.Second * 5}, "tcp", options.Addr, &tls.Config{ServerName: host})
+			}
+		}
+		client := redis.NewClient(options)
+		rs.client = client
+		rs.subscriber = client
+	}
 }
 
 func (rs *RedisStorage) HealthCheck() error {
@@ -199,12 +663,22 @@ func (rs *RedisStorage) HealthCheck() error {
 }
 
 func (rs *RedisStorage) Init(url string) error {
-	rs.client = redis.NewClient(&redis.Options{
-		Addr:     url,
-		Password: "",
-		DB:       0,
-	})
-	return nil
+	opts, err := ParseRedisURL(url)
+	if err != nil {
+		return err
+	}
+	rs.connect(opts)
+	if err = rs.migrateRoutes(); err != nil {
+		return err
+	}
+	return rs.migrateRedactionRules()
+}
+
+func (rs *RedisStorage) Close() {
+	if rs.subscriber != nil && rs.subscriber != rs.client {
+		rs.subscriber.Close()
+	}
+	rs.client.Close()
 }
 
 func (rs *RedisStorage) SetSession(key string, value LogSession, duration time.Duration) error {
@@ -227,14 +701,125 @@ func (rs *RedisStorage) GetSession(key string) (value LogSession, err error) {
 	return value, nil
 }
 
-func (rs *RedisStorage) GetRoutes() ([]Route, error) {
-	var routes []Route
-	vals, err := rs.client.LRange("routes", 0, -1).Result()
+// Routes are stored in redis as a hash per route ({routes}:route:id), the ids
+// of all routes are in the {routes}:ids set and the ids of the routes for each
+// app, site or space are in an index set (see routeIndexKey). The {routes} hash
+// tag keeps them in one cluster slot so transactions work with redis cluster.
+const (
+	redisRouteIds     = "{routes}:ids"
+	redisLegacyRoutes = "routes"
+)
+
+func redisRouteKey(id string) string {
+	return "{routes}:route:" + id
+}
+
+func routeIndexKey(key RouteKey) string {
+	switch key.Kind {
+	case RouteKindSite:
+		return "{routes}:index:site:" + key.Site
+	case RouteKindSpace:
+		return "{routes}:index:space:" + key.Space
+	default:
+		return "{routes}:index:app:" + key.App + ":" + key.Space
+	}
+}
+
+func routeToHash(route Route) (map[string]string, error) {
+	filters, err := marshalFilters(route.Filters)
 	if err != nil {
 		return nil, err
 	}
+	var expires = ""
+	if route.Expires != nil {
+		expires = route.Expires.Format(time.RFC3339Nano)
+	}
+	return map[string]string{
+		"id":      route.Id,
+		"app":     route.App,
+		"space":   route.Space,
+		"site":    route.Site,
+		"created": route.Created.Format(time.RFC3339Nano),
+		"updated": route.Updated.Format(time.RFC3339Nano),
+		"url":     route.DestinationUrl,
+		"filters": filters,
+		"expires": expires,
+	}, nil
+}
+
+func routeFromHash(hash map[string]string) (route Route, err error) {
+	route.Id = hash["id"]
+	route.App = hash["app"]
+	route.Space = hash["space"]
+	route.Site = hash["site"]
+	route.DestinationUrl = hash["url"]
+	if route.Created, err = time.Parse(time.RFC3339Nano, hash["created"]); err != nil {
+		return route, err
+	}
+	if route.Updated, err = time.Parse(time.RFC3339Nano, hash["updated"]); err != nil {
+		return route, err
+	}
+	if hash["expires"] != "" {
+		expires, err := time.Parse(time.RFC3339Nano, hash["expires"])
+		if err != nil {
+			return route, err
+		}
+		route.Expires = &expires
+	}
+	route.Filters, err = unmarshalFilters(hash["filters"])
+	return route, err
+}
+
+// migrateRoutes moves routes from the old routes list (a json blob per route)
+// into hashes, the list is renamed to {routes}:migrated (the same cluster slot
+// as routes) once it's copied.
+func (rs *RedisStorage) migrateRoutes() error {
+	kind, err := rs.client.Type(redisLegacyRoutes).Result()
+	if err != nil || kind != "list" {
+		return err
+	}
+	vals, err := rs.client.LRange(redisLegacyRoutes, 0, -1).Result()
+	if err != nil {
+		return err
+	}
 	for _, val := range vals {
-		route, err := UnmarshalRoute(string(val))
+		route, err := UnmarshalRoute(val)
+		if err != nil {
+			return err
+		}
+		if _, err = rs.insertRoute(route); err != nil {
+			return err
+		}
+	}
+	log.Printf("[storage] Migrated %d routes from the redis routes list\n", len(vals))
+	// another instance may have finished the migration first.
+	if err = rs.client.Rename(redisLegacyRoutes, "{routes}:migrated").Err(); err != nil && err.Error() != "ERR no such key" {
+		return err
+	}
+	return nil
+}
+
+// getRoutesByIds reads the routes in one round trip, ids without a route
+// (removed while reading) are skipped.
+func (rs *RedisStorage) getRoutesByIds(ids []string) ([]Route, error) {
+	var routes []Route = make([]Route, 0)
+	if len(ids) == 0 {
+		return routes, nil
+	}
+	pipe := rs.client.Pipeline()
+	defer pipe.Close()
+	cmds := make([]*redis.StringStringMapCmd, 0, len(ids))
+	for _, id := range ids {
+		cmds = append(cmds, pipe.HGetAll(redisRouteKey(id)))
+	}
+	if _, err := pipe.Exec(); err != nil {
+		return nil, err
+	}
+	for _, cmd := range cmds {
+		if len(cmd.Val()) == 0 {
+			continue
+		}
+		route, err := routeFromHash(cmd.Val())
 		if err != nil {
 			return nil, err
 		}
@@ -243,125 +828,593 @@ func (rs *RedisStorage) GetRoutes() ([]Route, error) {
 	return routes, nil
 }
 
+func (rs *RedisStorage) GetRoutes() ([]Route, error) {
+	ids, err := rs.client.SMembers(redisRouteIds).Result()
+	if err != nil {
+		return nil, err
+	}
+	return rs.getRoutesByIds(ids)
+}
+
+func (rs *RedisStorage) GetRoutesByKey(key RouteKey) ([]Route, error) {
+	ids, err := rs.client.SMembers(routeIndexKey(key)).Result()
+	if err != nil {
+		return nil, err
+	}
+	return rs.getRoutesByIds(ids)
+}
+
 func (rs *RedisStorage) GetRouteById(Id string) (*Route, error) {
-	routes_pkg, err := rs.GetRoutes()
+	hash, err := rs.client.HGetAll(redisRouteKey(Id)).Result()
 	if err != nil {
 		return nil, err
 	}
-	for _, r := range routes_pkg {
-		if r.Id == Id {
-			return &r, nil
+	if len(hash) == 0 {
+		return nil, ErrRouteNotFound
+	}
+	route, err := routeFromHash(hash)
+	if err != nil {
+		return nil, err
+	}
+	return &route, nil
+}
+
+// watchRoute runs fn in a transaction watching the route's hash, retrying if
+// the route was changed by someone else before the transaction ran.
+func (rs *RedisStorage) watchRoute(id string, fn func(*redis.Tx) error) (err error) {
+	for attempt := 0; attempt < 5; attempt++ {
+		if err = rs.client.Watch(fn, redisRouteKey(id)); err != redis.TxFailedErr {
+			return err
 		}
 	}
-	return nil, errors.New("No such drain found.")
+	return err
 }
 
 func (rs *RedisStorage) RemoveRoute(route Route) error {
-	b, err := MarshalRoute(route)
+	err := rs.watchRoute(route.Id, func(tx *redis.Tx) error {
+		hash, err := tx.HGetAll(redisRouteKey(route.Id)).Result()
+		if err != nil {
+			return err
+		}
+		if len(hash) == 0 {
+			return ErrRouteNotFound
+		}
+		// the index is from the stored route in case the one given differs.
+		existing, err := routeFromHash(hash)
+		if err != nil {
+			return err
+		}
+		cmds, err := tx.MultiExec(func() error {
+			tx.Del(redisRouteKey(route.Id))
+			tx.SRem(redisRouteIds, route.Id)
+			tx.SRem(routeIndexKey(existing.GetRouteKey()), route.Id)
+			return nil
+		})
+		if err == nil && cmds[0].(*redis.IntCmd).Val() == 0 {
+			return ErrRouteNotFound
+		}
+		return err
+	})
 	if err != nil {
 		return err
 	}
-	_, err = rs.client.LRem("routes", 1, b).Result()
-	return err
+	rs.notify(RouteRemoved, route)
+	return nil
+}
+
+// insertRoute adds the route if no route has its id, returning whether it did.
+func (rs *RedisStorage) insertRoute(route Route) (bool, error) {
+	hash, err := routeToHash(route)
+	if err != nil {
+		return false, err
+	}
+	var inserted bool
+	err = rs.watchRoute(route.Id, func(tx *redis.Tx) error {
+		exists, err := tx.Exists(redisRouteKey(route.Id)).Result()
+		if err != nil || exists {
+			return err
+		}
+		_, err = tx.MultiExec(func() error {
+			tx.HMSet(redisRouteKey(route.Id), hash)
+			tx.SAdd(redisRouteIds, route.Id)
+			tx.SAdd(routeIndexKey(route.GetRouteKey()), route.Id)
+			return nil
+		})
+		inserted = err == nil
+		return err
+	})
+	return inserted, err
 }
 
 func (rs *RedisStorage) AddRoute(route Route) error {
-	b, err := MarshalRoute(route)
+	inserted, err := rs.insertRoute(route)
 	if err != nil {
 		return err
 	}
-	_, err = rs.client.RPush("routes", b).Result()
-	return err
+	if inserted {
+		rs.notify(RouteAdded, route)
+	}
+	return nil
 }
 
 func (rs *RedisStorage) AddRoutes(routes []Route) error {
 	for _, route := range routes {
-		b, err := MarshalRoute(route)
-		if err != nil {
+		if err := rs.AddRoute(route); err != nil {
 			return err
 		}
-		_, err = rs.client.RPush("routes", b).Result()
+	}
+	return nil
+}
+
+// UpdateRoute changes the url, filters, expiry and updated time of an existing
+// route.
+func (rs *RedisStorage) UpdateRoute(route Route) error {
+	hash, err := routeToHash(route)
+	if err != nil {
+		return err
+	}
+	err = rs.watchRoute(route.Id, func(tx *redis.Tx) error {
+		exists, err := tx.Exists(redisRouteKey(route.Id)).Result()
 		if err != nil {
 			return err
 		}
+		if !exists {
+			return ErrRouteNotFound
+		}
+		_, err = tx.MultiExec(func() error {
+			tx.HMSet(redisRouteKey(route.Id), map[string]string{
+				"url":     hash["url"],
+				"filters": hash["filters"],
+				"updated": hash["updated"],
+				"expires": hash["expires"],
+			})
+			return nil
+		})
+		return err
+	})
+	if err != nil {
+		return err
 	}
+	rs.notify(RouteUpdated, route)
 	return nil
 }
 
+// notify tells watchers of a route change, failures are only a delay as the
+// shuttle still polls for changes.
+func (rs *RedisStorage) notify(changeType string, route Route) {
+	payload, err := marshalRouteChange(changeType, route)
+	if err != nil {
+		return
+	}
+	rs.client.Publish(routeChangesChannel, payload)
+}
+
+func (rs *RedisStorage) WatchRoutes() (<-chan RouteChange, error) {
+	pubsub, err := rs.subscriber.Subscribe(routeChangesChannel)
+	if err != nil {
+		return nil, err
+	}
+	changes := make(chan RouteChange, 100)
+	go func() {
+		defer close(changes)
+		defer pubsub.Close()
+		for {
+			// network errors are retried (and resubscribed) by ReceiveMessage.
+			msg, err := pubsub.ReceiveMessage()
+			if err != nil {
+				return
+			}
+			changes <- unmarshalRouteChange(msg.Payload)
+		}
+	}()
+	return changes, nil
+}
+
 
+// Redaction rules are stored in redis as a hash per rule ({redactions}:rule:id)
+// with the ids of all rules in the {redactions}:ids set.
+const (
+	redisRedactionIds     = "{redactions}:ids"
+	redisLegacyRedactions = "redactions"
+)
+
+func redisRedactionKey(id string) string {
+	return "{redactions}:rule:" + id
+}
+
+// migrateRedactionRules moves rules from the old redactions list (a json blob
+// per rule) into hashes, the list is renamed to {redactions}:migrated once it's
+// copied.
+func (rs *RedisStorage) migrateRedactionRules() error {
+	kind, err := rs.client.Type(redisLegacyRedactions).Result()
+	if err != nil || kind != "list" {
+		return err
+	}
+	vals, err := rs.client.LRange(redisLegacyRedactions, 0, -1).Result()
+	if err != nil {
+		return err
+	}
+	for _, val := range vals {
+		var rule RedactionRule
+		if err := json.Unmarshal([]byte(val), &rule); err != nil {
+			return err
+		}
+		if err = rs.AddRedactionRule(rule); err != nil {
+			return err
+		}
+	}
+	log.Printf("[storage] Migrated %d redaction rules from the redis redactions list\n", len(vals))
+	// another instance may have finished the migration first.
+	if err = rs.client.Rename(redisLegacyRedactions, "{redactions}:migrated").Err(); err != nil && err.Error() != "ERR no such key" {
+		return err
+	}
+	return nil
+}
+
+func (rs *RedisStorage) GetRedactionRules() ([]RedactionRule, error) {
+	var rules []RedactionRule = make([]RedactionRule, 0)
+	ids, err := rs.client.SMembers(redisRedactionIds).Result()
+	if err != nil || len(ids) == 0 {
+		return rules, err
+	}
+	pipe := rs.client.Pipeline()
+	defer pipe.Close()
+	cmds := make([]*redis.StringStringMapCmd, 0, len(ids))
+	for _, id := range ids {
+		cmds = append(cmds, pipe.HGetAll(redisRedactionKey(id)))
+	}
+	if _, err := pipe.Exec(); err != nil {
+		return nil, err
+	}
+	for _, cmd := range cmds {
+		hash := cmd.Val()
+		// removed while reading.
+		if len(hash) == 0 {
+			continue
+		}
+		created, err := time.Parse(time.RFC3339Nano, hash["created"])
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, RedactionRule{Id: hash["id"], App: hash["app"], Space: hash["space"], Pattern: hash["pattern"], Replacement: hash["replacement"], Created: created})
+	}
+	return rules, nil
+}
+
+// The rule's hash and the id set are changed in a transaction, the rule's key
+// is watched so the transaction goes to the right node with redis cluster.
+func (rs *RedisStorage) AddRedactionRule(rule RedactionRule) error {
+	return rs.client.Watch(func(tx *redis.Tx) error {
+		_, err := tx.MultiExec(func() error {
+			tx.HMSet(redisRedactionKey(rule.Id), map[string]string{
+				"id":          rule.Id,
+				"app":         rule.App,
+				"space":       rule.Space,
+				"pattern":     rule.Pattern,
+				"replacement": rule.Replacement,
+				"created":     rule.Created.Format(time.RFC3339Nano),
+			})
+			tx.SAdd(redisRedactionIds, rule.Id)
+			return nil
+		})
+		return err
+	}, redisRedactionKey(rule.Id))
+}
+
+func (rs *RedisStorage) RemoveRedactionRule(rule RedactionRule) error {
+	var removed int64
+	err := rs.client.Watch(func(tx *redis.Tx) error {
+		cmds, err := tx.MultiExec(func() error {
+			tx.Del(redisRedactionKey(rule.Id))
+			tx.SRem(redisRedactionIds, rule.Id)
+			return nil
+		})
+		if err == nil {
+			removed = cmds[0].(*redis.IntCmd).Val()
+		}
+		return err
+	}, redisRedactionKey(rule.Id))
+	if err != nil {
+		return err
+	}
+	if removed == 0 {
+		return ErrRedactionRuleNotFound
+	}
+	return nil
+}
 
 // Memory Interface
 
+// How often expired sessions are removed from memory storage.
+const memorySessionSweepInterval = time.Second * 10
+
+type memorySession struct {
+	value   LogSession
+	expires time.Time
+}
+
+// memorySnapshot is what memory storage persists, sessions are short lived
+// and aren't persisted.
+type memorySnapshot struct {
+	Routes     []Route         `json:"routes"`
+	Redactions []RedactionRule `json:"redactions"`
+	Audits     []RouteAudit    `json:"audits"`
+}
+
+// MemoryStorage keeps everything in memory, if Init is given a file path the
+// routes, redaction rules and route history are saved to it on every change
+// and loaded from it on start up. It's safe for concurrent use.
 type MemoryStorage struct {
 	Storage
-	routes []Route
-	sessions map[string]LogSession
+	mutex      sync.RWMutex
+	snapshot   string
+	routes     []Route
+	redactions []RedactionRule
+	audits     []RouteAudit
+	watchers   []chan RouteChange
+	sessions   map[string]memorySession
+	done       chan struct{}
+	closed     bool
+	closeOnce  sync.Once
 }
 
 func (ms *MemoryStorage) HealthCheck() error {
 	return nil
 }
 
-// Url is just a dummy interface.
+// The url is an optional snapshot file to persist routes to.
 func (ms *MemoryStorage) Init(url string) error {
+	ms.mutex.Lock()
+	ms.snapshot = url
 	ms.routes = make([]Route, 0)
-	ms.sessions = make(map[string]LogSession)
+	ms.redactions = make([]RedactionRule, 0)
+	ms.audits = make([]RouteAudit, 0)
+	ms.sessions = make(map[string]memorySession)
+	ms.done = make(chan struct{})
+	ms.mutex.Unlock()
+	if err := ms.load(); err != nil {
+		return err
+	}
+	go ms.sweep()
 	return nil
 }
 
+// Close stops sweeping expired sessions and closes the watchers' channels,
+// it's safe to call more than once or before Init.
+func (ms *MemoryStorage) Close() {
+	ms.closeOnce.Do(func() {
+		ms.mutex.Lock()
+		defer ms.mutex.Unlock()
+		if ms.done != nil {
+			close(ms.done)
+		}
+		for _, watcher := range ms.watchers {
+			close(watcher)
+		}
+		ms.watchers = nil
+		ms.closed = true
+	})
+}
+
+// load reads the snapshot if there is one.
+func (ms *MemoryStorage) load() error {
+	if ms.snapshot == "" {
+		return nil
+	}
+	data, err := ioutil.ReadFile(ms.snapshot)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var snapshot memorySnapshot
+	if err = json.Unmarshal(data, &snapshot); err != nil {
+		return err
+	}
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	if snapshot.Routes != nil {
+		ms.routes = snapshot.Routes
+	}
+	if snapshot.Redactions != nil {
+		ms.redactions = snapshot.Redactions
+	}
+	if snapshot.Audits != nil {
+		ms.audits = snapshot.Audits
+	}
+	return nil
+}
+
+// save writes the snapshot (if there is one), it's written to a temporary file
+// and renamed so a crash can't leave a partial snapshot. Must hold the lock.
+func (ms *MemoryStorage) save() error {
+	if ms.snapshot == "" {
+		return nil
+	}
+	data, err := json.Marshal(memorySnapshot{Routes: ms.routes, Redactions: ms.redactions, Audits: ms.audits})
+	if err != nil {
+		return err
+	}
+	if err = ioutil.WriteFile(ms.snapshot+".tmp", data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(ms.snapshot+".tmp", ms.snapshot)
+}
+
+// sweep removes expired sessions until the storage is closed.
+func (ms *MemoryStorage) sweep() {
+	t := time.NewTicker(memorySessionSweepInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ms.done:
+			return
+		case now := <-t.C:
+			ms.mutex.Lock()
+			for key, session := range ms.sessions {
+				if now.After(session.expires) {
+					delete(ms.sessions, key)
+				}
+			}
+			ms.mutex.Unlock()
+		}
+	}
+}
+
 func (ms *MemoryStorage) SetSession(key string, value LogSession, duration time.Duration) error {
-	ms.sessions[key] = value
-	go func() {
-		t := time.NewTicker(duration)
-		<-t.C
-		delete(ms.sessions, key)
-	}()
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	ms.sessions[key] = memorySession{value: value, expires: time.Now().Add(duration)}
 	return nil
 }
 
 func (ms *MemoryStorage) GetSession(key string) (value LogSession, err error) {
-	val, ok := ms.sessions[key]
-	if ok == true {
-		return val, nil
+	ms.mutex.RLock()
+	defer ms.mutex.RUnlock()
+	// sessions are only swept periodically, so check it hasn't expired since.
+	session, ok := ms.sessions[key]
+	if ok == true && time.Now().Before(session.expires) {
+		return session.value, nil
 	} else {
 		return LogSession{}, errors.New("Element was not found.")
 	}
 }
 
 func (ms *MemoryStorage) GetRoutes() ([]Route, error) {
-	return ms.routes, nil
+	ms.mutex.RLock()
+	defer ms.mutex.RUnlock()
+	return append([]Route{}, ms.routes...), nil
 }
 
-func (ms *MemoryStorage) GetRouteById(Id string) (*Route, error) {
-	routes_pkg, err := ms.GetRoutes()
-	if err != nil {
-		return nil, err
+func (ms *MemoryStorage) GetRoutesByKey(key RouteKey) ([]Route, error) {
+	ms.mutex.RLock()
+	defer ms.mutex.RUnlock()
+	var routes []Route = make([]Route, 0)
+	for _, r := range ms.routes {
+		if r.GetRouteKey() == key {
+			routes = append(routes, r)
+		}
 	}
-	for _, r := range routes_pkg {
+	return routes, nil
+}
+
+func (ms *MemoryStorage) GetRouteById(Id string) (*Route, error) {
+	ms.mutex.RLock()
+	defer ms.mutex.RUnlock()
+	for _, r := range ms.routes {
 		if r.Id == Id {
 			return &r, nil
 		}
 	}
-	return nil, errors.New("No such drain found.")
+	return nil, ErrRouteNotFound
 }
 
 func (ms *MemoryStorage) RemoveRoute(route Route) error {
-	routes_pkg, _ := ms.GetRoutes()
-	for i, r := range routes_pkg {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	for i, r := range ms.routes {
 		if r.Id == route.Id {
-			ms.routes = append(ms.routes[:i], ms.routes[i+1:]...)
-			break;
+			// copy so slices returned by GetRoutes aren't changed.
+			ms.routes = append(append([]Route{}, ms.routes[:i]...), ms.routes[i+1:]...)
+			ms.notify(RouteRemoved, route)
+			return ms.save()
 		}
 	}
-	return nil
+	return ErrRouteNotFound
 }
 
 func (ms *MemoryStorage) AddRoute(route Route) error {
-	ms.routes = append(ms.routes, route)
-	return nil
+	return ms.AddRoutes([]Route{route})
 }
 
+// AddRoutes adds routes, routes with an id that already exists are ignored.
 func (ms *MemoryStorage) AddRoutes(routes []Route) error {
-	ms.routes = append(ms.routes, routes...)
-	return nil
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	for _, route := range routes {
+		if ms.hasRoute(route.Id) {
+			continue
+		}
+		ms.routes = append(ms.routes, route)
+		ms.notify(RouteAdded, route)
+	}
+	return ms.save()
+}
+
+// Must hold the lock.
+func (ms *MemoryStorage) hasRoute(id string) bool {
+	for _, r := range ms.routes {
+		if r.Id == id {
+			return true
+		}
+	}
+	return false
+}
+
+// UpdateRoute changes the url, filters, expiry and updated time of an existing
+// route.
+func (ms *MemoryStorage) UpdateRoute(route Route) error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	for i, r := range ms.routes {
+		if r.Id == route.Id {
+			r.DestinationUrl = route.DestinationUrl
+			r.Filters = route.Filters
+			r.Updated = route.Updated
+			r.Expires = route.Expires
+			ms.routes = append([]Route{}, ms.routes...)
+			ms.routes[i] = r
+			ms.notify(RouteUpdated, r)
+			return ms.save()
+		}
+	}
+	return ErrRouteNotFound
+}
+
+// notify tells watchers of a route change, a watcher that isn't keeping up
+// misses the change (and picks it up when the shuttle next polls). Must hold
+// the lock.
+func (ms *MemoryStorage) notify(changeType string, route Route) {
+	for _, watcher := range ms.watchers {
+		select {
+		case watcher <- RouteChange{Type: changeType, Route: route}:
+		default:
+		}
+	}
+}
+
+func (ms *MemoryStorage) WatchRoutes() (<-chan RouteChange, error) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	if ms.closed {
+		return nil, errStorageClosed
+	}
+	changes := make(chan RouteChange, 100)
+	ms.watchers = append(ms.watchers, changes)
+	return changes, nil
+}
+
+func (ms *MemoryStorage) GetRedactionRules() ([]RedactionRule, error) {
+	ms.mutex.RLock()
+	defer ms.mutex.RUnlock()
+	return append([]RedactionRule{}, ms.redactions...), nil
+}
+
+func (ms *MemoryStorage) AddRedactionRule(rule RedactionRule) error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	ms.redactions = append(ms.redactions, rule)
+	return ms.save()
+}
+
+func (ms *MemoryStorage) RemoveRedactionRule(rule RedactionRule) error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	for i, r := range ms.redactions {
+		if r.Id == rule.Id {
+			ms.redactions = append(append([]RedactionRule{}, ms.redactions[:i]...), ms.redactions[i+1:]...)
+			return ms.save()
+		}
+	}
+	return ErrRedactionRuleNotFound
 }
@@ -1,7 +1,9 @@
 package syslog
 
 import (
+	"bytes"
 	"fmt"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -75,4 +77,107 @@ func Parse(line string) (Packet, error) {
 		Time:     t,
 		Message:  splitLine[1],
 	}, nil
-}
\ No newline at end of file
+}
+
+// ParseRFC5424 parses a single RFC5424 syslog line into a packet. Structured
+// data is skipped. When a PROCID is present (e.g., heroku style "app web.1")
+// it is used as the tag, otherwise the APP-NAME is.
+func ParseRFC5424(line string) (Packet, error) {
+	var packet Packet
+	line = strings.TrimRight(line, "\r\n")
+	if !strings.HasPrefix(line, "<") {
+		return packet, fmt.Errorf("missing priority in %q", line)
+	}
+	end := strings.Index(line, ">")
+	if end < 2 || end > 4 {
+		return packet, fmt.Errorf("invalid priority in %q", line)
+	}
+	priority, err := strconv.Atoi(line[1:end])
+	if err != nil || priority < 0 || priority > 191 {
+		return packet, fmt.Errorf("invalid priority in %q", line)
+	}
+	fields := strings.SplitN(line[end+1:], " ", 7)
+	if len(fields) != 7 || fields[0] != "1" {
+		return packet, fmt.Errorf("couldn't parse header of %q", line)
+	}
+	ts := time.Now()
+	if fields[1] != "-" {
+		if ts, err = time.Parse(time.RFC3339Nano, fields[1]); err != nil {
+			return packet, err
+		}
+	}
+	tag := fields[3]
+	if fields[4] != "-" {
+		tag = fields[4]
+	}
+	message, err := skipStructuredData(fields[6])
+	if err != nil {
+		return packet, err
+	}
+	return Packet{
+		Severity: Priority(priority & 7),
+		Facility: Priority(priority >> 3),
+		Hostname: fields[2],
+		Tag:      tag,
+		Time:     ts,
+		Message:  message,
+	}, nil
+}
+
+// skipStructuredData removes the structured data section (either
+// "-" or one or more [id key="value"] elements) and returns the message.
+func skipStructuredData(rest string) (string, error) {
+	if strings.HasPrefix(rest, "-") {
+		return strings.TrimPrefix(strings.TrimPrefix(rest, "-"), " "), nil
+	}
+	var inQuote = false
+	var depth = 0
+	for i := 0; i < len(rest); i++ {
+		switch rest[i] {
+		case '\\':
+			if inQuote {
+				i++
+			}
+		case '"':
+			inQuote = !inQuote
+		case '[':
+			if !inQuote {
+				depth++
+			}
+		case ']':
+			if !inQuote {
+				depth--
+				if depth == 0 && (i+1 == len(rest) || rest[i+1] != '[') {
+					return strings.TrimPrefix(rest[i+1:], " "), nil
+				}
+			}
+		}
+		if depth == 0 && !inQuote && rest[i] != ']' {
+			return "", fmt.Errorf("invalid structured data in %q", rest)
+		}
+	}
+	return "", fmt.Errorf("unterminated structured data in %q", rest)
+}
+
+// ParseFrames splits an octet counted (application/logplex-1) body into its
+// individual syslog lines, as produced by the http drain.
+func ParseFrames(body []byte) ([]string, error) {
+	var lines = make([]string, 0)
+	for len(body) > 0 {
+		sp := bytes.IndexByte(body, ' ')
+		if sp < 1 {
+			return nil, fmt.Errorf("invalid frame, missing octet count")
+		}
+		size, err := strconv.Atoi(string(body[0:sp]))
+		if err != nil || size < 0 {
+			return nil, fmt.Errorf("invalid frame, bad octet count %q", body[0:sp])
+		}
+		body = body[sp+1:]
+		if size > len(body) {
+			return nil, fmt.Errorf("invalid frame, expected %d bytes but only %d remain", size, len(body))
+		}
+		lines = append(lines, strings.TrimRight(string(body[0:size]), "\r\n"))
+		body = bytes.TrimLeft(body[size:], "\r\n")
+	}
+	return lines, nil
+}
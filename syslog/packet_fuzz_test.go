@@ -0,0 +1,62 @@
+//go:build go1.18
+// +build go1.18
+
+package syslog
+
+import (
+	"bytes"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+// Logplex bodies are untrusted client input, the seed corpus is in
+// testdata/fuzz/FuzzParseFrames, run with: go test -fuzz FuzzParseFrames ./syslog
+func FuzzParseFrames(f *testing.F) {
+	f.Add([]byte("5 hello6 world!"))
+	f.Add([]byte("68 <134>1 2020-01-01T00:00:00Z app-space app web.1 - [meta a=\"1\"] hello\n"))
+	f.Fuzz(func(t *testing.T, body []byte) {
+		lines, err := ParseFrames(body)
+		for _, line := range lines {
+			if packet, err := ParseRFC5424(line); err == nil {
+				if packet.Severity > SevDebug || packet.Facility > LogLocal7 {
+					t.Fatalf("priority of %q out of range: %d", line, packet.Priority())
+				}
+			}
+		}
+		if err != nil {
+			return
+		}
+		// Anything that parses must survive being framed and parsed again.
+		var framed bytes.Buffer
+		for _, line := range lines {
+			framed.WriteString(strconv.Itoa(len(line)) + " " + line + "\n")
+		}
+		reparsed, err := ParseFrames(framed.Bytes())
+		if err != nil {
+			t.Fatalf("unable to reparse %q: %s", framed.String(), err)
+		}
+		if !reflect.DeepEqual(lines, reparsed) {
+			t.Fatalf("round trip of %q differs: %#v != %#v", body, lines, reparsed)
+		}
+	})
+}
+
+// A parsed line must generate a line that parses to the same packet.
+func FuzzParseRFC5424(f *testing.F) {
+	f.Add("<134>1 2020-01-01T00:00:00Z app-space app web.1 - - hello")
+	f.Add(`<14>1 2020-01-01T00:00:00Z host app - - [meta a="1"][b@1 c="x\"]y"] with sd`)
+	f.Fuzz(func(t *testing.T, line string) {
+		packet, err := ParseRFC5424(line)
+		if err != nil {
+			return
+		}
+		reparsed, err := ParseRFC5424(packet.Generate(0))
+		if err != nil {
+			t.Fatalf("unable to reparse %q: %s", packet.Generate(0), err)
+		}
+		if reparsed.Priority() != packet.Priority() || reparsed.Hostname != packet.Hostname || reparsed.Tag != packet.Tag || reparsed.Message != packet.cleanMessage() {
+			t.Fatalf("round trip of %q differs: %#v != %#v", line, packet, reparsed)
+		}
+	})
+}
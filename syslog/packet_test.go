@@ -0,0 +1,123 @@
+package syslog
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+	"time"
+)
+
+func TestParseRFC5424(t *testing.T) {
+	Convey("Ensure syslog lines are parsed into packets.", t, func() {
+		var tests = []struct {
+			line     string
+			severity Priority
+			facility Priority
+			hostname string
+			tag      string
+			message  string
+		}{
+			{`<134>1 2020-01-01T00:00:00Z app-space app web.1 - - hello`, SevInfo, LogLocal0, "app-space", "web.1", "hello"},
+			{`<11>1 2020-01-01T00:00:00.123456+02:00 app-space akkeris/router - - - oh error`, SevErr, LogUser, "app-space", "akkeris/router", "oh error"},
+			// NILVALUE hostname, app name, procid and msgid
+			{`<14>1 2020-01-01T00:00:00Z - - - - - nothing set`, SevInfo, LogUser, "-", "-", "nothing set"},
+			// structured data is skipped, including escaped quotes and brackets
+			{`<14>1 2020-01-01T00:00:00Z host app - - [meta a="1"][b@1 c="x\"]y" d="\\"] with sd`, SevInfo, LogUser, "host", "app", "with sd"},
+			{`<14>1 2020-01-01T00:00:00Z host app - - [meta a="1"]`, SevInfo, LogUser, "host", "app", ""},
+			{`<14>1 2020-01-01T00:00:00Z host app - - -`, SevInfo, LogUser, "host", "app", ""},
+			{"<14>1 2020-01-01T00:00:00Z host app - - - trailing newline\r\n", SevInfo, LogUser, "host", "app", "trailing newline"},
+			{`<14>1 2020-01-01T00:00:00Z host app - - - a message - - - with dashes`, SevInfo, LogUser, "host", "app", "a message - - - with dashes"},
+			{`<0>1 2020-01-01T00:00:00Z host app - - - lowest`, SevEmerg, LogKern, "host", "app", "lowest"},
+			{`<191>1 2020-01-01T00:00:00Z host app - - - highest`, SevDebug, LogLocal7, "host", "app", "highest"},
+		}
+		for _, test := range tests {
+			packet, err := ParseRFC5424(test.line)
+			So(err, ShouldEqual, nil)
+			So(packet.Severity, ShouldEqual, test.severity)
+			So(packet.Facility, ShouldEqual, test.facility)
+			So(packet.Hostname, ShouldEqual, test.hostname)
+			So(packet.Tag, ShouldEqual, test.tag)
+			So(packet.Message, ShouldEqual, test.message)
+		}
+	})
+	Convey("Ensure the timestamp is parsed, or now if it's the NILVALUE.", t, func() {
+		packet, err := ParseRFC5424(`<14>1 2020-01-01T00:00:00.123456+02:00 host app - - - hello`)
+		So(err, ShouldEqual, nil)
+		So(packet.Time.Equal(time.Date(2019, 12, 31, 22, 0, 0, 123456000, time.UTC)), ShouldBeTrue)
+		before := time.Now()
+		packet, err = ParseRFC5424(`<14>1 - host app - - - hello`)
+		So(err, ShouldEqual, nil)
+		So(packet.Time, ShouldHappenOnOrAfter, before)
+	})
+	Convey("Ensure invalid syslog lines are rejected.", t, func() {
+		var lines = []string{
+			``,
+			`no priority`,
+			`<>1 2020-01-01T00:00:00Z host app - - - empty priority`,
+			`<abc>1 2020-01-01T00:00:00Z host app - - - bad priority`,
+			`<192>1 2020-01-01T00:00:00Z host app - - - priority too high`,
+			`<-1>1 2020-01-01T00:00:00Z host app - - - negative priority`,
+			`<14 2020-01-01T00:00:00Z host app - - - unterminated priority`,
+			`<14>2 2020-01-01T00:00:00Z host app - - - wrong version`,
+			`<14>1 2020-01-01T00:00:00Z host app - -`,
+			`<14>1 yesterday host app - - - bad time`,
+			`<14>1 2020-01-01T00:00:00Z host app - - no structured data`,
+			`<14>1 2020-01-01T00:00:00Z host app - - [meta a="1" unterminated`,
+			`<14>1 2020-01-01T00:00:00Z host app - - [meta a="]"`,
+		}
+		for _, line := range lines {
+			_, err := ParseRFC5424(line)
+			So(err, ShouldNotEqual, nil)
+		}
+	})
+	Convey("Ensure generated packets can be parsed.", t, func() {
+		packet := Packet{Severity: SevWarning, Facility: LogLocal3, Hostname: "app-space", Tag: "worker.2", Time: time.Date(2020, 1, 1, 0, 0, 0, 5000, time.UTC), Message: "multi\nline"}
+		parsed, err := ParseRFC5424(packet.Generate(0))
+		So(err, ShouldEqual, nil)
+		So(parsed.Priority(), ShouldEqual, packet.Priority())
+		So(parsed.Hostname, ShouldEqual, "app-space")
+		So(parsed.Tag, ShouldEqual, "worker.2")
+		So(parsed.Time.Equal(packet.Time), ShouldBeTrue)
+		So(parsed.Message, ShouldEqual, "multi line")
+	})
+}
+
+func TestParseFrames(t *testing.T) {
+	Convey("Ensure octet counted bodies are split into lines.", t, func() {
+		var tests = []struct {
+			body  string
+			lines []string
+		}{
+			{``, []string{}},
+			{`5 hello`, []string{"hello"}},
+			{`5 hello6 world!`, []string{"hello", "world!"}},
+			// newlines between and at the end of frames are ignored.
+			{"6 hello\n7 world!\n\r\n", []string{"hello", "world!"}},
+			// the count is in bytes, not characters.
+			{"6 héllo3 abc", []string{"héllo", "abc"}},
+			{"0 5 hello", []string{"", "hello"}},
+			{"11 hello world", []string{"hello world"}},
+			{"12 hello\nworld\n", []string{"hello\nworld"}},
+		}
+		for _, test := range tests {
+			lines, err := ParseFrames([]byte(test.body))
+			So(err, ShouldEqual, nil)
+			So(lines, ShouldResemble, test.lines)
+		}
+	})
+	Convey("Ensure truncated, oversized and unframed bodies are rejected.", t, func() {
+		var bodies = []string{
+			`hello`,
+			` 5 hello`,
+			`five hello`,
+			`-1 hello`,
+			`6 hello`,
+			`5 hello100 world`,
+			`99999999999999999999 hello`,
+			`5 hello 5 world`,
+		}
+		for _, body := range bodies {
+			_, err := ParseFrames([]byte(body))
+			So(err, ShouldNotEqual, nil)
+		}
+	})
+}
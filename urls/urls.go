@@ -0,0 +1,43 @@
+// Package urls has helpers for drain urls shared by the storage and drains.
+package urls
+
+import (
+	"net"
+	"net/url"
+	"strings"
+)
+
+// Redact masks the credentials in a drain url, the password (or user if
+// there's no password), the port of syslog urls (papertrail style drains use
+// it as the account) and the values of query parameters that look secret.
+// Urls that can't be parsed are redacted entirely.
+func Redact(value string) string {
+	u, err := url.Parse(value)
+	if err != nil || u.Host == "" {
+		return "[redacted]"
+	}
+	if strings.HasPrefix(u.Scheme, "syslog") && u.Port() != "" {
+		u.Host = net.JoinHostPort(u.Hostname(), "redacted")
+	}
+	if u.User != nil {
+		if _, ok := u.User.Password(); ok {
+			u.User = url.UserPassword(u.User.Username(), "redacted")
+		} else {
+			u.User = url.User("redacted")
+		}
+	}
+	if u.RawQuery != "" {
+		query := u.Query()
+		for name := range query {
+			lower := strings.ToLower(name)
+			for _, secret := range []string{"token", "key", "pass", "secret", "auth", "sig"} {
+				if strings.Contains(lower, secret) {
+					query.Set(name, "redacted")
+					break
+				}
+			}
+		}
+		u.RawQuery = query.Encode()
+	}
+	return u.String()
+}